@@ -24,8 +24,15 @@ type Automerge struct {
 	txnSeq             uint32
 	currentTransaction transaction.Transaction
 	queue              []*Change
-	lock               sync.Mutex
+	lock               sync.RWMutex
 	enableAnalysis     bool
+	savedChanges       int // number of changes in history covered by the last save
+	observer           *opset.Observer
+	subscribers        []func([]Patch)
+	clocks             map[ChangeHash]map[uuid.UUID]uint64 // latest operation of every actor a head depends on
+	acks               map[uuid.UUID]map[uuid.UUID]uint64  // clock of the latest change of every other actor
+	historyCache       []historicalOpSet                   // OpSets rebuilt at past heads, latest used last
+	historyCacheLock   sync.Mutex                          // readers holding the read lock share the cache
 }
 
 func NewAutomerge(actorId uuid.UUID) *Automerge {
@@ -33,11 +40,13 @@ func NewAutomerge(actorId uuid.UUID) *Automerge {
 	return &Automerge{
 		history:        make([]*Change, 0),
 		historyIndex:   map[ChangeHash]int{},
+		clocks:         map[ChangeHash]map[uuid.UUID]uint64{},
+		acks:           map[uuid.UUID]map[uuid.UUID]uint64{},
 		dependencies:   make([]ChangeHash, 0),
 		ops:            opset.NewOpSet(actorId),
 		actorId:        actorId,
 		maxOp:          0,
-		lock:           sync.Mutex{},
+		lock:           sync.RWMutex{},
 		enableAnalysis: false,
 	}
 }
@@ -52,23 +61,91 @@ func (a *Automerge) StartTransaction() transaction.Transaction {
 }
 
 func (a *Automerge) CommitTransaction() {
+	if _, err := a.commitTransaction(); err != nil {
+		panic(err)
+	}
+}
+
+// commitTransaction adds the current transaction to the history and releases the lock. If the
+// transaction can't be committed, it is rolled back.
+func (a *Automerge) commitTransaction() (*Change, error) {
+	locked := true
 	defer func() {
 		if err := recover(); err != nil {
-			a.lock.Unlock()
+			// don't leave the document locked forever
+			if locked {
+				a.lock.Unlock()
+			}
 			panic(err)
-		} else {
-			a.lock.Unlock()
 		}
 	}()
-	if change, err := a.currentTransaction.Commit(); err == nil {
-		a.history = append(a.history, change)
-		a.historyIndex[change.Hash()] = len(a.history) - 1
-		a.dependencies = []ChangeHash{change.Hash()}
-		a.maxOp = a.ops.GetLamportClock().Counter
-	} else {
-		panic(err)
+	change, err := a.currentTransaction.Commit()
+	if err != nil {
+		locked = false
+		a.RollbackTransaction()
+		return nil, err
 	}
+	a.history = append(a.history, change)
+	a.historyIndex[change.Hash()] = len(a.history) - 1
+	a.dependencies = []ChangeHash{change.Hash()}
+	a.maxOp = a.ops.GetLamportClock().Counter
+	a.acknowledge(change)
+	a.truncateMoveLog()
 	logrus.Info("Commit transaction")
+	var patches [][]Patch
+	if a.observer != nil {
+		patches = [][]Patch{a.observer.Patches(change.Operations)}
+	}
+	locked = false
+	a.unlockAndNotify(patches)
+	return change, nil
+}
+
+// Subscribe registers callback to receive the patches of every local commit and every applied
+// remote change. It is called after the document is unlocked, so it may read the document.
+func (a *Automerge) Subscribe(callback func([]Patch)) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.observer == nil {
+		a.observer = a.ops.NewObserver()
+	}
+	a.subscribers = append(a.subscribers, callback)
+}
+
+func notify(subscribers []func([]Patch), patches [][]Patch) {
+	for _, batch := range patches {
+		for _, callback := range subscribers {
+			callback(batch)
+		}
+	}
+}
+
+// RollbackTransaction abandons the current transaction, undoing all of its operations
+func (a *Automerge) RollbackTransaction() {
+	defer a.lock.Unlock()
+	a.currentTransaction.Rollback()
+	a.txnSeq = a.txnSeq - 1
+	logrus.Info("Rollback transaction")
+}
+
+// Transact runs fn in a new transaction, which is committed if fn returns nil and rolled back if fn
+// returns an error or panics
+func (a *Automerge) Transact(fn func(tx Transaction) error) (*Change, error) {
+	tx := a.StartTransaction()
+	returned := false
+	defer func() {
+		if !returned {
+			// fn panicked, the panic continues after the rollback
+			a.RollbackTransaction()
+		}
+	}()
+	err := fn(tx)
+	returned = true
+	if err != nil {
+		a.RollbackTransaction()
+		return nil, err
+	}
+	return a.commitTransaction()
 }
 
 func (a *Automerge) GetHistory() []byte {
@@ -84,6 +161,73 @@ func (a *Automerge) GetHistory() []byte {
 	}
 }
 
+// Save encodes the whole change history of the document into a compact binary format
+func (a *Automerge) Save() []byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.savedChanges = len(a.history)
+	return transaction.EncodeChanges(a.history, a.ops)
+}
+
+// SaveIncremental encodes only the changes added since the last Save or SaveIncremental. The result
+// can be appended to the bytes of the previous save.
+func (a *Automerge) SaveIncremental() []byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	changes := a.history[a.savedChanges:]
+	a.savedChanges = len(a.history)
+	return transaction.EncodeChanges(changes, a.ops)
+}
+
+// LoadIncremental applies the changes of chunks produced by SaveIncremental on top of the document
+func (a *Automerge) LoadIncremental(bytes []byte) error {
+	a.lock.Lock()
+	// decoding registers the actors of the changes in the OpSet, so it needs the lock, too
+	changes, err := transaction.DecodeChanges(bytes, a.ops)
+	if err != nil {
+		a.lock.Unlock()
+		return err
+	}
+	upToDate := a.savedChanges == len(a.history)
+	_, patches := a.applyChanges(changes)
+	if upToDate {
+		// the loaded changes are already persisted, so don't save them again
+		a.savedChanges = len(a.history)
+	}
+	missingDeps := false
+	for _, change := range changes {
+		if _, ok := a.historyIndex[change.Hash()]; !ok {
+			missingDeps = true
+		}
+	}
+	a.unlockAndNotify(patches)
+	if missingDeps {
+		// they stay queued like received changes, until their dependencies arrive
+		return errors.New("loaded changes have missing dependencies")
+	}
+	return nil
+}
+
+// Load rebuilds a document from bytes produced by Save, optionally followed by incremental chunks
+func Load(actorId uuid.UUID, bytes []byte) (*Automerge, error) {
+	doc := NewAutomerge(actorId)
+	changes, err := transaction.DecodeChanges(bytes, doc.ops)
+	if err != nil {
+		return nil, err
+	}
+	doc.ApplyChanges(changes)
+	if len(doc.queue) > 0 {
+		return nil, errors.New("saved document has missing dependencies")
+	}
+	for _, change := range doc.history {
+		if change.ActorId == actorId && change.Seq > doc.txnSeq {
+			doc.txnSeq = change.Seq
+		}
+	}
+	doc.savedChanges = len(doc.history)
+	return doc, nil
+}
+
 func (a *Automerge) GetLatestChange() (*Change, error) {
 	if len(a.history) == 0 {
 		return nil, errors.New("no changes")
@@ -100,6 +244,108 @@ func (a *Automerge) GetLatestChangeBytes() ([]byte, error) {
 	}
 }
 
+// GetHeads returns the hashes of the changes that no other change depends on
+func (a *Automerge) GetHeads() []ChangeHash {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return append([]ChangeHash{}, a.dependencies...)
+}
+
+// GetChanges returns the changes that are not causally covered by the given heads, in the order
+// they were added to the history. Unknown heads are ignored.
+func (a *Automerge) GetChanges(since []ChangeHash) []*Change {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.getChanges(since)
+}
+
+func (a *Automerge) getChanges(since []ChangeHash) []*Change {
+	covered := a.ancestors(since)
+	changes := make([]*Change, 0)
+	for _, change := range a.history {
+		if !covered[change.Hash()] {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// GetMissingDeps returns the dependencies of queued changes that are neither applied nor queued
+func (a *Automerge) GetMissingDeps() []ChangeHash {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.getMissingDeps(nil)
+}
+
+// getMissingDeps additionally reports the given heads if they are unknown
+func (a *Automerge) getMissingDeps(heads []ChangeHash) []ChangeHash {
+	queued := map[ChangeHash]bool{}
+	for _, change := range a.queue {
+		queued[change.Hash()] = true
+	}
+	missing := make([]ChangeHash, 0)
+	seen := map[ChangeHash]bool{}
+	addMissing := func(dep ChangeHash) {
+		if _, ok := a.historyIndex[dep]; ok || queued[dep] || seen[dep] {
+			return
+		}
+		seen[dep] = true
+		missing = append(missing, dep)
+	}
+	for _, change := range a.queue {
+		for _, dep := range change.Dependencies {
+			addMissing(dep)
+		}
+	}
+	for _, head := range heads {
+		addMissing(head)
+	}
+	return missing
+}
+
+// EncodeChanges encodes changes of this document in the binary format used by Save, so that they
+// can be sent to another peer
+func (a *Automerge) EncodeChanges(changes []*Change) []byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return transaction.EncodeChanges(changes, a.ops)
+}
+
+// ApplyEncodedChanges decodes changes produced by EncodeChanges of another peer and applies them
+func (a *Automerge) ApplyEncodedChanges(bytes []byte) ([]*Change, error) {
+	a.lock.Lock()
+	// decoding registers the actors of the changes in the OpSet, so it needs the lock, too
+	changes, err := transaction.DecodeChanges(bytes, a.ops)
+	if err != nil {
+		a.lock.Unlock()
+		return nil, err
+	}
+	applied, patches := a.applyChanges(changes)
+	a.unlockAndNotify(patches)
+	return applied, nil
+}
+
+// ancestors returns the given known changes together with all changes they transitively depend on
+func (a *Automerge) ancestors(heads []ChangeHash) map[ChangeHash]bool {
+	result := map[ChangeHash]bool{}
+	stack := make([]ChangeHash, 0, len(heads))
+	for _, head := range heads {
+		if _, ok := a.historyIndex[head]; ok {
+			stack = append(stack, head)
+		}
+	}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if result[hash] {
+			continue
+		}
+		result[hash] = true
+		stack = append(stack, a.history[a.historyIndex[hash]].Dependencies...)
+	}
+	return result
+}
+
 func (a *Automerge) isCausallyReady(change *Change) bool {
 	for _, dep := range change.Dependencies {
 		if _, ok := a.historyIndex[dep]; !ok {
@@ -110,14 +356,35 @@ func (a *Automerge) isCausallyReady(change *Change) bool {
 }
 
 func (a *Automerge) ApplyChanges(changes []*Change) []*Change {
-	applied := make([]*Change, 0)
 	a.lock.Lock()
-	defer a.lock.Unlock()
+	applied, patches := a.applyChanges(changes)
+	a.unlockAndNotify(patches)
+	return applied
+}
+
+// unlockAndNotify releases the lock and then passes the patches to the subscribers
+func (a *Automerge) unlockAndNotify(patches [][]Patch) {
+	subscribers := append([]func([]Patch){}, a.subscribers...)
+	a.lock.Unlock()
+	notify(subscribers, patches)
+}
+
+// applyChanges applies the causally ready changes and returns them, together with their patches if
+// the document is observed. The operations of all changes are inserted first and the move log is
+// undone and redone once for all of them, rather than once per change.
+func (a *Automerge) applyChanges(changes []*Change) ([]*Change, [][]Patch) {
+	applied := make([]*Change, 0)
+	patches := make([][]Patch, 0)
+	operations := make([]*Operation, 0)
+	apply := func(c *Change) {
+		a.applyChange(c)
+		applied = append(applied, c)
+		operations = append(operations, c.Operations...)
+	}
 	for _, c := range changes {
 		if _, ok := a.historyIndex[c.Hash()]; !ok {
 			if a.isCausallyReady(c) {
-				a.applyChange(c)
-				applied = append(applied, c)
+				apply(c)
 			} else {
 				a.queue = append(a.queue, c)
 			}
@@ -126,9 +393,13 @@ func (a *Automerge) ApplyChanges(changes []*Change) []*Change {
 	for len(a.queue) > 0 {
 		found := false
 		for i := 0; i < len(a.queue); i++ { // pop next causally ready change
+			if _, ok := a.historyIndex[a.queue[i].Hash()]; ok { // delivered again after it was queued
+				a.queue = append(a.queue[:i], a.queue[i+1:]...)
+				found = true
+				break
+			}
 			if a.isCausallyReady(a.queue[i]) {
-				a.applyChange(a.queue[i])
-				applied = append(applied, a.queue[i])
+				apply(a.queue[i])
 				a.queue = append(a.queue[:i], a.queue[i+1:]...)
 				found = true
 				break
@@ -138,9 +409,17 @@ func (a *Automerge) ApplyChanges(changes []*Change) []*Change {
 			break
 		}
 	}
-	return applied
+	if len(operations) > 0 {
+		a.ops.BulkUpdateValidity(operations)
+		a.truncateMoveLog()
+		if a.observer != nil {
+			patches = append(patches, a.observer.Patches(operations))
+		}
+	}
+	return applied, patches
 }
 
+// applyChange records a change and inserts its operations, whose validity is updated by the caller
 func (a *Automerge) applyChange(change *Change) {
 	changeId := strconv.Itoa(int(a.ops.GetIdx(change.ActorId))) + "-" + strconv.Itoa(int(change.Seq))
 	logrus.SetFormatter(log.NewApplyingFormatter(changeId, a.enableAnalysis))
@@ -161,13 +440,86 @@ func (a *Automerge) applyChange(change *Change) {
 		}
 	}
 	a.dependencies = append(filtered, change.Hash())
+	a.acknowledge(change)
 	for i := range change.Operations {
 		a.ops.InsertOperation(change.Operations[i])
 	}
-	a.ops.BulkUpdateValidity(change.Operations)
 	logrus.Info("Finish applying change")
 }
 
+// acknowledge records which operations a change depends on. A change of another actor acknowledges
+// all of them: the later changes of its actor depend on them, too. Only the clocks of the heads are
+// kept, a change that depends on an older change acknowledges the operations of its actor.
+func (a *Automerge) acknowledge(change *Change) {
+	clock := map[uuid.UUID]uint64{}
+	for _, dep := range change.Dependencies {
+		depClock, ok := a.clocks[dep]
+		if !ok {
+			depChange := a.history[a.historyIndex[dep]]
+			depClock = map[uuid.UUID]uint64{depChange.ActorId: depChange.StartOp + uint64(len(depChange.Operations))}
+		}
+		for actor, latest := range depClock {
+			if latest > clock[actor] {
+				clock[actor] = latest
+			}
+		}
+	}
+	latest := change.StartOp + uint64(len(change.Operations)) // the counters start after StartOp
+	if latest > clock[change.ActorId] {
+		clock[change.ActorId] = latest
+	}
+	heads := make(map[ChangeHash]map[uuid.UUID]uint64, len(a.dependencies))
+	for _, head := range a.dependencies {
+		heads[head] = a.clocks[head]
+	}
+	heads[change.Hash()] = clock
+	a.clocks = heads
+	if change.ActorId == a.actorId {
+		return
+	}
+	if ack, ok := a.acks[change.ActorId]; !ok || ack[change.ActorId] < latest {
+		a.acks[change.ActorId] = clock
+	}
+}
+
+// truncateMoveLog drops the moves from the move log that every known actor has acknowledged. The
+// later operations of these actors depend on the moves, so they are greater and never undo them.
+// Our own later operations depend on everything we have. As long as no other actor acknowledged
+// anything, we don't know who has the document, so nothing is stable.
+func (a *Automerge) truncateMoveLog() {
+	if len(a.acks) == 0 {
+		return
+	}
+	stable := map[uuid.UUID]uint64{}
+	for _, head := range a.dependencies {
+		for actor, latest := range a.clocks[head] {
+			if latest > stable[actor] {
+				stable[actor] = latest
+			}
+		}
+	}
+	for _, clock := range a.acks {
+		for actor, latest := range stable {
+			if clock[actor] < latest {
+				stable[actor] = clock[actor]
+			}
+		}
+	}
+	frontier := map[uint]uint64{}
+	for actor, latest := range stable {
+		frontier[a.ops.GetIdx(actor)] = latest
+	}
+	a.ops.TruncateMoveLog(frontier)
+}
+
+// MoveLogStats returns counters of the work done by the move log, e.g. how many moves the latest
+// applied operations had to undo and redo
+func (a *Automerge) MoveLogStats() MoveLogStats {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.ops.MoveLogStats()
+}
+
 func (a *Automerge) Merge(b *Automerge) {
 	changes := transaction.NewChangeArrayFromBytes(b.GetHistory(), a.ops)
 	a.ApplyChanges(changes)
@@ -176,6 +528,7 @@ func (a *Automerge) Merge(b *Automerge) {
 func (a *Automerge) Fork() *Automerge {
 	id, _ := uuid.NewRandom()
 	doc := NewAutomerge(id)
+	doc.SetTextEncoding(a.TextEncoding())
 	doc.Merge(a)
 	return doc
 }
@@ -224,6 +577,21 @@ func (a *Automerge) EnableAnalysis() {
 	a.enableAnalysis = true
 }
 
+// SetTextEncoding sets the unit in which positions and lengths of text objects are counted. It is
+// local to this replica, because the text itself is stored character by character.
+func (a *Automerge) SetTextEncoding(encoding TextEncoding) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.ops.SetTextEncoding(encoding)
+	a.historyCache = nil
+}
+
+func (a *Automerge) TextEncoding() TextEncoding {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.ops.TextEncoding()
+}
+
 func (a *Automerge) GetDocumentTree() map[ExOpId]ExOpId {
 	return a.ops.GetDocumentTree()
 }
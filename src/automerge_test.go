@@ -3,9 +3,16 @@ package automergeproto
 import (
 	"github.com/LiangrunDa/AutomergeWithMove/errors"
 	"github.com/LiangrunDa/AutomergeWithMove/internal/opset"
+	"github.com/LiangrunDa/AutomergeWithMove/internal/transaction"
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMap(t *testing.T) {
@@ -83,7 +90,7 @@ func TestListAndMap(t *testing.T) {
 	value, _ := tx.Get(liangrunMapId, "name")
 	assert.Equal(t, "Liangrun", value)
 	value, _ = tx.Get(liangrunMapId, "age")
-	assert.Equal(t, float64(99), value)
+	assert.Equal(t, int64(99), value)
 	doc.CommitTransaction()
 }
 
@@ -892,3 +899,1819 @@ func TestBenchmarkMove(t *testing.T) {
 	//fmt.Println(doc1.ops.Visualize())
 
 }
+
+func TestSaveLoad(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	tx := doc1.StartTransaction()
+	A, _ := tx.PutObject(ExRootOpId, "A", opset.MAP)
+	B, _ := tx.PutObject(ExRootOpId, "B", opset.MAP)
+	todoList, _ := tx.PutObject(ExRootOpId, "todo list", opset.LIST)
+	tx.Put(A, "a1", "1")
+	tx.Put(A, "a2", 2)
+	tx.Insert(todoList, 0, "buy milk")
+	tx.Insert(todoList, 1, "water plants")
+	tx.Insert(todoList, 2, "phone Joe")
+	doc1.CommitTransaction()
+
+	doc2 := doc1.Fork()
+	tx2 := doc2.StartTransaction()
+	_ = tx2.Move(ExRootOpId, B, "A", "A")
+	_ = tx2.Move(todoList, todoList, 2, 0)
+	doc2.CommitTransaction()
+
+	tx3 := doc1.StartTransaction()
+	_ = tx3.Move(A, B, "a1", "b1")
+	doc1.CommitTransaction()
+	doc1.Merge(doc2)
+
+	saved := doc1.Save()
+	id2, _ := uuid.NewRandom()
+	loaded, err := Load(id2, saved)
+	assert.Nil(t, err)
+	assert.Equal(t, saved, loaded.Save())
+
+	tx4 := loaded.StartTransaction()
+	movedA, _ := tx4.Get(B, "A")
+	assert.Equal(t, A, movedA)
+	value, _ := tx4.Get(B, "b1")
+	assert.Equal(t, "1", value)
+	value, _ = tx4.Get(A, "a2")
+	assert.Equal(t, int64(2), value)
+	output := []string{"phone Joe", "buy milk", "water plants"}
+	for i := 0; i < 3; i++ {
+		value, _ := tx4.Get(todoList, i)
+		assert.Equal(t, output[i], value)
+	}
+	tx4.Put(A, "a3", "3")
+	loaded.CommitTransaction()
+
+	doc1.Merge(loaded)
+	tx5 := doc1.StartTransaction()
+	value, _ = tx5.Get(A, "a3")
+	assert.Equal(t, "3", value)
+	doc1.CommitTransaction()
+
+	_, err = Load(id2, saved[:len(saved)-1])
+	assert.NotNil(t, err)
+}
+
+func TestSaveIncremental(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	tx := doc1.StartTransaction()
+	A, _ := tx.PutObject(ExRootOpId, "A", opset.MAP)
+	B, _ := tx.PutObject(ExRootOpId, "B", opset.MAP)
+	tx.Put(A, "a1", "1")
+	doc1.CommitTransaction()
+	file := doc1.Save()
+
+	id2, _ := uuid.NewRandom()
+	doc2, _ := Load(id2, file)
+
+	tx2 := doc1.StartTransaction()
+	tx2.Put(A, "a2", "2")
+	doc1.CommitTransaction()
+	chunk1 := doc1.SaveIncremental()
+	file = append(file, chunk1...)
+
+	tx3 := doc1.StartTransaction()
+	_ = tx3.Move(ExRootOpId, B, "A", "A")
+	doc1.CommitTransaction()
+	chunk2 := doc1.SaveIncremental()
+	file = append(file, chunk2...)
+	assert.Less(t, len(chunk2), len(doc1.Save()))
+
+	loaded, err := Load(id2, file)
+	assert.Nil(t, err)
+	assert.Equal(t, doc1.Save(), loaded.Save())
+
+	assert.Nil(t, doc2.LoadIncremental(append(chunk1, chunk2...)))
+	assert.Equal(t, 3, len(doc2.history))
+	tx4 := doc2.StartTransaction()
+	value, _ := tx4.Get(A, "a2")
+	assert.Equal(t, "2", value)
+	movedA, _ := tx4.Get(B, "A")
+	assert.Equal(t, A, movedA)
+	doc2.CommitTransaction()
+
+	// a chunk whose dependencies are missing is an error, like for Load
+	doc3, _ := Load(id2, file[:len(file)-len(chunk1)-len(chunk2)])
+	assert.NotNil(t, doc3.LoadIncremental(chunk2))
+	assert.Equal(t, 1, len(doc3.history))
+
+	// a chunk that can't be decoded doesn't register its actors
+	id3, _ := uuid.NewRandom()
+	doc4 := NewAutomerge(id3)
+	actors := doc4.ops.ActorCount()
+	assert.NotNil(t, doc4.LoadIncremental(chunk1[:len(chunk1)-1]))
+	assert.Equal(t, actors, doc4.ops.ActorCount())
+}
+
+func TestGetChangesSinceHeads(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	tx := doc1.StartTransaction()
+	A, _ := tx.PutObject(ExRootOpId, "A", opset.MAP)
+	B, _ := tx.PutObject(ExRootOpId, "B", opset.MAP)
+	doc1.CommitTransaction()
+
+	doc2 := doc1.Fork()
+	heads := doc2.GetHeads()
+	assert.Equal(t, doc1.GetHeads(), heads)
+	assert.Equal(t, 0, len(doc1.GetChanges(heads)))
+
+	tx2 := doc1.StartTransaction()
+	tx2.Put(A, "a1", "1")
+	doc1.CommitTransaction()
+	tx3 := doc1.StartTransaction()
+	_ = tx3.Move(ExRootOpId, B, "A", "A")
+	doc1.CommitTransaction()
+	tx4 := doc2.StartTransaction()
+	tx4.Put(B, "b1", "1")
+	doc2.CommitTransaction()
+
+	changes := doc1.GetChanges(heads)
+	assert.Equal(t, 2, len(changes))
+
+	// deliver the changes out of order: the move is queued until its dependency arrives
+	_, _ = doc2.ApplyEncodedChanges(doc1.EncodeChanges(changes[1:]))
+	assert.Equal(t, []ChangeHash{changes[0].Hash()}, doc2.GetMissingDeps())
+	_, _ = doc2.ApplyEncodedChanges(doc1.EncodeChanges(doc1.GetChanges(doc2.GetHeads())))
+	assert.Equal(t, 0, len(doc2.GetMissingDeps()))
+	_, _ = doc1.ApplyEncodedChanges(doc2.EncodeChanges(doc2.GetChanges(heads)))
+	assert.ElementsMatch(t, doc1.GetHeads(), doc2.GetHeads())
+	assert.Equal(t, 2, len(doc1.GetHeads()))
+
+	tx5 := doc2.StartTransaction()
+	movedA, _ := tx5.Get(B, "A")
+	assert.Equal(t, A, movedA)
+	value, _ := tx5.Get(A, "a1")
+	assert.Equal(t, "1", value)
+	doc2.CommitTransaction()
+}
+
+func syncDocs(t *testing.T, doc1 *Automerge, state1 *SyncState, doc2 *Automerge, state2 *SyncState) int {
+	rounds := 0
+	for ; rounds < 20; rounds++ {
+		msg1, ok1 := doc1.GenerateSyncMessage(state1)
+		if ok1 {
+			assert.Nil(t, doc2.ReceiveSyncMessage(state2, msg1))
+		}
+		msg2, ok2 := doc2.GenerateSyncMessage(state2)
+		if ok2 {
+			assert.Nil(t, doc1.ReceiveSyncMessage(state1, msg2))
+		}
+		if !ok1 && !ok2 {
+			break
+		}
+	}
+	return rounds
+}
+
+func TestSync(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	tx := doc1.StartTransaction()
+	A, _ := tx.PutObject(ExRootOpId, "A", opset.MAP)
+	B, _ := tx.PutObject(ExRootOpId, "B", opset.MAP)
+	C, _ := tx.PutObject(ExRootOpId, "C", opset.MAP)
+	tx.Put(A, "a1", "1")
+	doc1.CommitTransaction()
+
+	id2, _ := uuid.NewRandom()
+	doc2 := NewAutomerge(id2)
+	state1, state2 := NewSyncState(), NewSyncState()
+	syncDocs(t, doc1, state1, doc2, state2)
+	assert.Equal(t, doc1.GetHeads(), doc2.GetHeads())
+
+	// concurrent moves of A, the peers reconnect with persisted sync states
+	for i := 0; i < 5; i++ {
+		tx1 := doc1.StartTransaction()
+		tx1.Put(B, "b"+strconv.Itoa(i), i)
+		doc1.CommitTransaction()
+	}
+	tx1 := doc1.StartTransaction()
+	_ = tx1.Move(ExRootOpId, B, "A", "A")
+	doc1.CommitTransaction()
+	tx2 := doc2.StartTransaction()
+	_ = tx2.Move(ExRootOpId, C, "A", "A")
+	tx2.Put(C, "c1", "1")
+	doc2.CommitTransaction()
+
+	state1, _ = DecodeSyncState(state1.Encode())
+	state2, _ = DecodeSyncState(state2.Encode())
+	rounds := syncDocs(t, doc1, state1, doc2, state2)
+	assert.Less(t, rounds, 20)
+	assert.ElementsMatch(t, doc1.GetHeads(), doc2.GetHeads())
+	assert.Equal(t, 2, len(doc1.GetHeads()))
+	assert.Equal(t, doc1.GetDocumentTree(), doc2.GetDocumentTree())
+	_, ok := doc1.GenerateSyncMessage(state1)
+	assert.False(t, ok)
+
+	tx3 := doc1.StartTransaction()
+	tx4 := doc2.StartTransaction()
+	for _, key := range []string{"b0", "b4", "A"} {
+		value1, err1 := tx3.Get(B, key)
+		value2, err2 := tx4.Get(B, key)
+		assert.Equal(t, value1, value2)
+		assert.Equal(t, err1, err2)
+	}
+	value, _ := tx4.Get(C, "c1")
+	assert.Equal(t, "1", value)
+	doc1.CommitTransaction()
+	doc2.CommitTransaction()
+
+	// peers that start with the same heads stop after telling each other their heads
+	doc3 := doc1.Fork()
+	state1, state3 := NewSyncState(), NewSyncState()
+	rounds = syncDocs(t, doc1, state1, doc3, state3)
+	assert.Less(t, rounds, 2)
+	_, ok = doc1.GenerateSyncMessage(state1)
+	assert.False(t, ok)
+	_, ok = doc3.GenerateSyncMessage(state3)
+	assert.False(t, ok)
+}
+
+func TestMaterialize(t *testing.T) {
+	id, _ := uuid.NewRandom()
+	doc := NewAutomerge(id)
+	tx := doc.StartTransaction()
+	queue, _ := tx.PutObject(ExRootOpId, "queue", opset.LIST)
+	alice, _ := tx.InsertObject(queue, 0, opset.MAP)
+	tx.Put(alice, "name", "Alice")
+	bob, _ := tx.InsertObject(queue, 1, opset.MAP)
+	tx.Put(bob, "name", "Bob")
+	tx.Insert(queue, 2, "Carol")
+	_ = tx.Delete(queue, 2)
+	leader, _ := tx.PutObject(ExRootOpId, "leader", opset.MAP)
+	tx.Put(leader, "duration", "1day")
+	tx.Move(queue, leader, 0, "person")
+	doc.CommitTransaction()
+
+	value, err := doc.Materialize(ExRootOpId)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{
+		"queue": []any{map[string]any{"name": "Bob"}},
+		"leader": map[string]any{
+			"duration": "1day",
+			"person":   map[string]any{"name": "Alice"},
+		},
+	}, value)
+
+	json, err := doc.ToJSON(leader)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"duration":"1day","person":{"name":"Alice"}}`, string(json))
+
+	_, err = doc.Materialize(ExOpId{ActorId: id, Counter: 100})
+	assert.IsType(t, errors.ObjectNotFoundError{}, err)
+}
+
+func TestReadWithoutTransaction(t *testing.T) {
+	id, _ := uuid.NewRandom()
+	doc := NewAutomerge(id)
+	tx := doc.StartTransaction()
+	students, _ := tx.PutObject(ExRootOpId, "students", opset.LIST)
+	liangrun, _ := tx.InsertObject(students, 0, opset.MAP)
+	tx.Put(liangrun, "name", "Liangrun")
+	tx.Put(liangrun, "age", 21)
+	tx.Insert(students, 1, "Leo")
+	tx.Put(ExRootOpId, "course", "CRDT")
+	doc.CommitTransaction()
+	historyLen := len(doc.history)
+
+	value, err := doc.Get(students, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, liangrun, value)
+	value, _ = doc.Get(liangrun, "name")
+	assert.Equal(t, "Liangrun", value)
+	keys, _ := doc.Keys(ExRootOpId)
+	assert.Equal(t, []string{"course", "students"}, keys)
+	length, _ := doc.Length(students)
+	assert.Equal(t, 2, length)
+	values, _ := doc.Values(students)
+	assert.Equal(t, []any{liangrun, "Leo"}, values)
+	values, _ = doc.Values(liangrun)
+	assert.Equal(t, []any{int64(21), "Liangrun"}, values)
+	objType, _ := doc.ObjectType(students)
+	assert.Equal(t, opset.LIST, objType)
+
+	unknownActor, _ := uuid.NewRandom()
+	_, err = doc.Get(ExOpId{ActorId: unknownActor, Counter: 1}, "name")
+	assert.IsType(t, errors.ObjectNotFoundError{}, err)
+	_, err = doc.Keys(ExOpId{ActorId: id, Counter: 100})
+	assert.IsType(t, errors.ObjectNotFoundError{}, err)
+	_, err = doc.Get(students, "name")
+	assert.IsType(t, errors.InvalidOperationError{}, err)
+	assert.Equal(t, historyLen, len(doc.history))
+}
+
+func TestGetAllConflicts(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	tx := doc1.StartTransaction()
+	A, _ := tx.PutObject(ExRootOpId, "A", opset.MAP)
+	B, _ := tx.PutObject(ExRootOpId, "B", opset.MAP)
+	list, _ := tx.PutObject(ExRootOpId, "list", opset.LIST)
+	tx.Insert(list, 0, "a")
+	tx.Put(A, "a1", "1")
+	doc1.CommitTransaction()
+
+	doc2 := doc1.Fork()
+	tx1 := doc1.StartTransaction()
+	tx1.Put(ExRootOpId, "name", "Liangrun")
+	tx1.Put(list, 0, "x")
+	_ = tx1.Move(A, B, "a1", "b1")
+	doc1.CommitTransaction()
+	tx2 := doc2.StartTransaction()
+	tx2.Put(ExRootOpId, "name", "Leo")
+	tx2.Put(list, 0, "y")
+	tx2.Put(B, "b1", "2")
+	doc2.CommitTransaction()
+	doc1.Merge(doc2)
+
+	conflicts, err := doc1.GetAll(ExRootOpId, "name")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(conflicts))
+	assert.ElementsMatch(t, []any{"Liangrun", "Leo"}, []any{conflicts[0].Value, conflicts[1].Value})
+	winner, _ := doc1.Get(ExRootOpId, "name")
+	assert.Equal(t, winner, conflicts[1].Value)
+
+	conflicts, _ = doc1.GetAll(list, 0)
+	assert.ElementsMatch(t, []any{"x", "y"}, []any{conflicts[0].Value, conflicts[1].Value})
+
+	// the moved scalar conflicts with the value put concurrently at its destination
+	conflicts, _ = doc1.GetAll(B, "b1")
+	assert.ElementsMatch(t, []any{"1", "2"}, []any{conflicts[0].Value, conflicts[1].Value})
+	assert.NotEqual(t, conflicts[0].OpId, conflicts[1].OpId)
+
+	tx3 := doc1.StartTransaction()
+	conflicts, _ = tx3.GetAll(ExRootOpId, "name")
+	assert.Equal(t, 2, len(conflicts))
+	tx3.Put(ExRootOpId, "name", "Liangrun Da")
+	conflicts, _ = tx3.GetAll(ExRootOpId, "name")
+	assert.Equal(t, []ConflictValue{{Value: "Liangrun Da", OpId: conflicts[0].OpId}}, conflicts)
+	doc1.CommitTransaction()
+}
+
+func TestReadAtHeads(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	tx := doc1.StartTransaction()
+	A, _ := tx.PutObject(ExRootOpId, "A", opset.MAP)
+	B, _ := tx.PutObject(ExRootOpId, "B", opset.MAP)
+	C, _ := tx.PutObject(ExRootOpId, "C", opset.MAP)
+	tx.Put(A, "a1", "1")
+	doc1.CommitTransaction()
+	initial := doc1.GetHeads()
+
+	doc2 := doc1.Fork()
+	tx2 := doc2.StartTransaction()
+	_ = tx2.Move(ExRootOpId, B, "A", "A")
+	doc2.CommitTransaction()
+	tx3 := doc1.StartTransaction()
+	_ = tx3.Move(ExRootOpId, C, "A", "A")
+	tx3.Put(A, "a1", "2")
+	doc1.CommitTransaction()
+	beforeMerge := doc1.GetHeads()
+	doc1.Merge(doc2)
+
+	value, _ := doc1.GetAt(initial, ExRootOpId, "A")
+	assert.Equal(t, A, value)
+	value, _ = doc1.GetAt(initial, A, "a1")
+	assert.Equal(t, "1", value)
+	keys, _ := doc1.KeysAt(initial, ExRootOpId)
+	assert.Equal(t, []string{"A", "B", "C"}, keys)
+	length, _ := doc1.LengthAt(initial, C)
+	assert.Equal(t, 0, length)
+
+	// before the merge, our own move was the only one and therefore valid
+	value, _ = doc1.GetAt(beforeMerge, C, "A")
+	assert.Equal(t, A, value)
+	_, err := doc1.GetAt(beforeMerge, B, "A")
+	assert.Equal(t, errors.PropertyNotFoundError{PropertyName: "A"}, err)
+	state, _ := doc1.MaterializeAt(beforeMerge, ExRootOpId)
+	assert.Equal(t, map[string]any{
+		"B": map[string]any{},
+		"C": map[string]any{"A": map[string]any{"a1": "2"}},
+	}, state)
+
+	current, _ := doc1.Materialize(ExRootOpId)
+	latest, _ := doc1.MaterializeAt(doc1.GetHeads(), ExRootOpId)
+	assert.Equal(t, current, latest)
+
+	_, err = doc1.GetAt([]ChangeHash{{1}}, ExRootOpId, "A")
+	assert.IsType(t, errors.ChangeNotFoundError{}, err)
+
+	// reads at the same heads share one rebuilt OpSet, also if the heads name redundant ancestors
+	ops, _ := doc1.opSetAt(beforeMerge)
+	cached, _ := doc1.opSetAt(append(append([]ChangeHash{}, beforeMerge...), initial...))
+	assert.Same(t, ops, cached)
+	for i := 0; i < historyCacheSize; i++ {
+		doc1.Transact(func(tx Transaction) error {
+			return tx.Put(A, "a1", strconv.Itoa(i))
+		})
+		doc1.GetAt(doc1.GetHeads(), A, "a1")
+	}
+	assert.Equal(t, historyCacheSize, len(doc1.historyCache))
+	rebuilt, _ := doc1.opSetAt(beforeMerge)
+	assert.NotSame(t, ops, rebuilt)
+}
+
+func TestMovedTwiceLeavesEarlierKeys(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	var X ExOpId
+	doc1.Transact(func(tx Transaction) error {
+		X, _ = tx.PutObject(ExRootOpId, "a", MAP)
+		return nil
+	})
+	doc1.Transact(func(tx Transaction) error {
+		return tx.Move(ExRootOpId, ExRootOpId, "a", "b")
+	})
+	doc1.Transact(func(tx Transaction) error {
+		return tx.Move(ExRootOpId, ExRootOpId, "b", "c")
+	})
+
+	// the first move lost against the second one, but X doesn't go back to "a"
+	keys, _ := doc1.Keys(ExRootOpId)
+	assert.Equal(t, []string{"c"}, keys)
+	_, err := doc1.Get(ExRootOpId, "a")
+	assert.Equal(t, errors.PropertyNotFoundError{PropertyName: "a"}, err)
+	value, _ := doc1.Get(ExRootOpId, "c")
+	assert.Equal(t, X, value)
+
+	// the same holds for a replica that receives both moves at once
+	id2, _ := uuid.NewRandom()
+	doc2 := NewAutomerge(id2)
+	doc2.Merge(doc1)
+	keys, _ = doc2.Keys(ExRootOpId)
+	assert.Equal(t, []string{"c"}, keys)
+}
+
+func TestForkAtAndRevertTo(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	tx := doc1.StartTransaction()
+	A, _ := tx.PutObject(ExRootOpId, "A", opset.MAP)
+	B, _ := tx.PutObject(ExRootOpId, "B", opset.MAP)
+	C, _ := tx.PutObject(B, "C", opset.MAP)
+	tx.Put(A, "a1", "1")
+	tx.Put(C, "c1", "1")
+	todoList, _ := tx.PutObject(ExRootOpId, "todo list", opset.LIST)
+	tx.Insert(todoList, 0, "buy milk")
+	tx.Insert(todoList, 1, "water plants")
+	task, _ := tx.InsertObject(todoList, 2, opset.MAP)
+	tx.Put(task, "title", "phone Joe")
+	doc1.CommitTransaction()
+	heads := doc1.GetHeads()
+	expected, _ := doc1.Materialize(ExRootOpId)
+
+	tx2 := doc1.StartTransaction()
+	_ = tx2.Move(ExRootOpId, B, "A", "A")
+	_ = tx2.Move(todoList, todoList, 2, 0)
+	_ = tx2.Delete(todoList, 1)
+	tx2.Insert(todoList, 0, "new task")
+	_ = tx2.Delete(B, "C")
+	tx2.Put(A, "a1", "2")
+	tx2.Put(ExRootOpId, "extra", "x")
+	doc1.CommitTransaction()
+	doc2 := doc1.Fork()
+
+	forked, err := doc1.ForkAt(heads)
+	assert.Nil(t, err)
+	state, _ := forked.Materialize(ExRootOpId)
+	assert.Equal(t, expected, state)
+	assert.Equal(t, heads, forked.GetHeads())
+
+	assert.Nil(t, doc1.RevertTo(heads))
+	state, _ = doc1.Materialize(ExRootOpId)
+	assert.Equal(t, expected, state)
+	// moved objects are moved back rather than recreated
+	value, _ := doc1.Get(ExRootOpId, "A")
+	assert.Equal(t, A, value)
+	value, _ = doc1.Get(todoList, 2)
+	assert.Equal(t, task, value)
+
+	doc2.Merge(doc1)
+	state, _ = doc2.Materialize(ExRootOpId)
+	assert.Equal(t, expected, state)
+}
+
+func TestRevertToSwapsCountersAndMarks(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	var X, Y, Z, list, text ExOpId
+	_, err := doc1.Transact(func(tx Transaction) error {
+		X, _ = tx.PutObject(ExRootOpId, "a", MAP)
+		Y, _ = tx.PutObject(ExRootOpId, "b", MAP)
+		Z, _ = tx.PutObject(X, "child", MAP)
+		tx.Put(Z, "name", "Z")
+		list, _ = tx.PutObject(ExRootOpId, "list", LIST)
+		tx.InsertObject(list, 0, MAP)
+		tx.InsertObject(list, 1, LIST)
+		tx.Put(ExRootOpId, "likes", Counter(3))
+		text, _ = tx.PutObject(ExRootOpId, "text", TEXT)
+		tx.Splice(text, 0, 0, "hello world")
+		return tx.Mark(text, 0, 5, "bold", true, ExpandNone)
+	})
+	assert.Nil(t, err)
+	heads := doc1.GetHeads()
+	expected, _ := doc1.Materialize(ExRootOpId)
+	expectedMarks, _ := doc1.Marks(text)
+	first, _ := doc1.Get(list, 0)
+
+	_, err = doc1.Transact(func(tx Transaction) error {
+		// swap a and b, then nest X in Z, which was its child
+		_ = tx.Move(ExRootOpId, ExRootOpId, "a", "tmp")
+		_ = tx.Move(ExRootOpId, ExRootOpId, "b", "a")
+		_ = tx.Move(ExRootOpId, ExRootOpId, "tmp", "b")
+		_ = tx.Move(X, ExRootOpId, "child", "c")
+		_ = tx.Move(ExRootOpId, Z, "b", "x")
+		_ = tx.Move(list, list, 0, 1)
+		_ = tx.Increment(ExRootOpId, "likes", 4)
+		_ = tx.Unmark(text, 0, 5, "bold", ExpandNone)
+		return tx.Mark(text, 6, 11, "italic", true, ExpandNone)
+	})
+	assert.Nil(t, err)
+	// objects moved more than once don't show up again where they were before
+	keys, _ := doc1.Keys(ExRootOpId)
+	assert.Equal(t, []string{"a", "c", "likes", "list", "text"}, keys)
+	values, _ := doc1.GetAll(ExRootOpId, "a")
+	assert.Equal(t, 1, len(values))
+	doc2 := doc1.Fork()
+	_, err = doc2.Transact(func(tx Transaction) error {
+		return tx.Increment(ExRootOpId, "likes", 10)
+	})
+	assert.Nil(t, err)
+
+	assert.Nil(t, doc1.RevertTo(heads))
+	state, _ := doc1.Materialize(ExRootOpId)
+	assert.Equal(t, expected, state)
+	marks, _ := doc1.Marks(text)
+	assert.Equal(t, expectedMarks, marks)
+	// swapped objects are moved back rather than recreated
+	for key, object := range map[string]ExOpId{"a": X, "b": Y} {
+		value, _ := doc1.Get(ExRootOpId, key)
+		assert.Equal(t, object, value)
+	}
+	value, _ := doc1.Get(X, "child")
+	assert.Equal(t, Z, value)
+	value, _ = doc1.Get(list, 0)
+	assert.Equal(t, first, value)
+
+	// the counter is incremented back, so a concurrent increment still counts
+	doc1.Merge(doc2)
+	value, _ = doc1.Get(ExRootOpId, "likes")
+	assert.Equal(t, Counter(13), value)
+}
+
+func TestRollbackTransaction(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	build := func() (*Automerge, ExOpId, ExOpId, ExOpId) {
+		doc := NewAutomerge(id1)
+		tx := doc.StartTransaction()
+		A, _ := tx.PutObject(ExRootOpId, "A", opset.MAP)
+		B, _ := tx.PutObject(ExRootOpId, "B", opset.MAP)
+		tx.Put(A, "a1", "1")
+		todoList, _ := tx.PutObject(ExRootOpId, "todo list", opset.LIST)
+		tx.Insert(todoList, 0, "buy milk")
+		tx.Insert(todoList, 1, "water plants")
+		doc.CommitTransaction()
+		return doc, A, B, todoList
+	}
+	doc1, A, B, todoList := build()
+	doc2, _, _, _ := build()
+
+	tx := doc1.StartTransaction()
+	_ = tx.Move(ExRootOpId, A, "B", "B")
+	_ = tx.Move(ExRootOpId, A, "A", "C")
+	_ = tx.Move(todoList, todoList, 1, 0)
+	_ = tx.Delete(todoList, 1)
+	tx.Insert(todoList, 0, "new task")
+	tx.Put(A, "a1", "2")
+	C, _ := tx.PutObject(B, "C", opset.MAP)
+	tx.Put(C, "c1", "1")
+	doc1.RollbackTransaction()
+
+	// the whole internal state is restored, not just what is visible
+	assert.True(t, reflect.DeepEqual(doc2.ops, doc1.ops))
+	assert.Equal(t, doc2.txnSeq, doc1.txnSeq)
+
+	// the document stays usable and produces the same changes as if nothing happened
+	tx = doc1.StartTransaction()
+	tx.Put(B, "b1", "1")
+	doc1.CommitTransaction()
+	tx = doc2.StartTransaction()
+	tx.Put(B, "b1", "1")
+	doc2.CommitTransaction()
+	assert.Equal(t, doc2.GetHeads(), doc1.GetHeads())
+	assert.Equal(t, doc2.Save(), doc1.Save())
+
+	// a move that would create a cycle followed by a valid move of the same object, both rolled back
+	doc3, A, B, _ := build()
+	doc4, _, _, _ := build()
+	_, err := doc3.Transact(func(tx Transaction) error {
+		_ = tx.Move(ExRootOpId, B, "A", "A")
+		_ = tx.Move(ExRootOpId, A, "B", "B")
+		_ = tx.Move(ExRootOpId, ExRootOpId, "B", "C")
+		return errors.InvalidOperationError{}
+	})
+	assert.NotNil(t, err)
+	assert.True(t, reflect.DeepEqual(doc4.ops, doc3.ops))
+}
+
+func TestTransact(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	var todoList ExOpId
+	change, err := doc1.Transact(func(tx Transaction) error {
+		var err error
+		if todoList, err = tx.PutObject(ExRootOpId, "todo list", opset.LIST); err != nil {
+			return err
+		}
+		return tx.Insert(todoList, 0, "buy milk")
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []ChangeHash{change.Hash()}, doc1.GetHeads())
+	expected, _ := doc1.Materialize(ExRootOpId)
+
+	// errors of mutating methods reach the caller, and the transaction is rolled back
+	change, err = doc1.Transact(func(tx Transaction) error {
+		if err := tx.Put(ExRootOpId, "title", "todo"); err != nil {
+			return err
+		}
+		return tx.Put(todoList, 1, "water plants")
+	})
+	assert.Nil(t, change)
+	assert.Equal(t, errors.ListIndexExceedsLengthError{Index: 1}, err)
+	state, _ := doc1.Materialize(ExRootOpId)
+	assert.Equal(t, expected, state)
+
+	_, err = doc1.Transact(func(tx Transaction) error {
+		return tx.Insert(todoList, 2, "water plants")
+	})
+	assert.Equal(t, errors.ListIndexExceedsLengthError{Index: 2}, err)
+	_, err = doc1.Transact(func(tx Transaction) error {
+		return tx.Put(todoList, "title", "todo")
+	})
+	assert.IsType(t, errors.InvalidOperationError{}, err)
+
+	// a panic rolls back the transaction and releases the lock
+	assert.Panics(t, func() {
+		_, _ = doc1.Transact(func(tx Transaction) error {
+			_ = tx.Put(ExRootOpId, "title", "todo")
+			panic("failure")
+		})
+	})
+	state, _ = doc1.Materialize(ExRootOpId)
+	assert.Equal(t, expected, state)
+
+	_, err = doc1.Transact(func(tx Transaction) error {
+		return tx.Put(ExRootOpId, "title", "todo")
+	})
+	assert.Nil(t, err)
+	value, _ := doc1.Get(ExRootOpId, "title")
+	assert.Equal(t, "todo", value)
+	assert.Equal(t, 2, len(doc1.history))
+
+	_, err = doc1.Transact(func(tx Transaction) error {
+		item, _ := tx.InsertObject(todoList, 1, opset.MAP)
+		_ = tx.Delete(todoList, 1)
+		return tx.MoveObject(item, ExRootOpId)
+	})
+	assert.IsType(t, errors.ObjectNotFoundError{}, err)
+
+	// a panic while committing releases the lock, too
+	doc1.StartTransaction()
+	doc1.currentTransaction = panickingCommit{doc1.currentTransaction}
+	assert.Panics(t, doc1.CommitTransaction)
+	value, _ = doc1.Get(ExRootOpId, "title")
+	assert.Equal(t, "todo", value)
+}
+
+type panickingCommit struct {
+	Transaction
+}
+
+func (panickingCommit) Commit() (*Change, error) {
+	panic("failure")
+}
+
+func TestText(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	var text, A ExOpId
+	_, err := doc1.Transact(func(tx Transaction) error {
+		var err error
+		if text, err = tx.PutObject(ExRootOpId, "note", TEXT); err != nil {
+			return err
+		}
+		if A, err = tx.PutObject(ExRootOpId, "A", MAP); err != nil {
+			return err
+		}
+		return tx.Splice(text, 0, 0, "hello world")
+	})
+	assert.Nil(t, err)
+	doc2 := doc1.Fork()
+
+	_, err = doc1.Transact(func(tx Transaction) error {
+		return tx.Splice(text, 0, 5, "Hi")
+	})
+	assert.Nil(t, err)
+	_, err = doc2.Transact(func(tx Transaction) error {
+		return tx.Splice(text, 11, 0, "!")
+	})
+	assert.Nil(t, err)
+	doc1.Merge(doc2)
+	doc2.Merge(doc1)
+	for _, doc := range []*Automerge{doc1, doc2} {
+		str, _ := doc.Text(text)
+		assert.Equal(t, "Hi world!", str)
+	}
+
+	// a text can be moved as a whole
+	_, err = doc2.Transact(func(tx Transaction) error {
+		return tx.MoveObject(text, A)
+	})
+	assert.Nil(t, err)
+	doc1.Merge(doc2)
+	state, _ := doc1.Materialize(ExRootOpId)
+	assert.Equal(t, map[string]any{"A": map[string]any{"note": "Hi world!"}}, state)
+
+	// positions are code points by default, or UTF-16 code units
+	_, err = doc1.Transact(func(tx Transaction) error {
+		return tx.Splice(text, 0, 2, "😀")
+	})
+	assert.Nil(t, err)
+	length, _ := doc1.Length(text)
+	assert.Equal(t, 8, length)
+	doc1.SetTextEncoding(UTF16)
+	length, _ = doc1.Length(text)
+	assert.Equal(t, 9, length)
+	_, err = doc1.Transact(func(tx Transaction) error {
+		return tx.Splice(text, 1, 1, "")
+	})
+	assert.IsType(t, errors.InvalidOperationError{}, err)
+	_, err = doc1.Transact(func(tx Transaction) error {
+		return tx.Splice(text, 2, 0, "!")
+	})
+	assert.Nil(t, err)
+	str, _ := doc1.Text(text)
+	assert.Equal(t, "😀! world!", str)
+
+	loaded, err := Load(id1, doc1.Save())
+	assert.Nil(t, err)
+	str, _ = loaded.Text(text)
+	assert.Equal(t, "😀! world!", str)
+}
+
+func TestConcurrentSplices(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	var text ExOpId
+	_, err := doc1.Transact(func(tx Transaction) error {
+		text, _ = tx.PutObject(ExRootOpId, "note", TEXT)
+		return tx.Splice(text, 0, 0, "hello world")
+	})
+	assert.Nil(t, err)
+	doc2 := doc1.Fork()
+
+	// the characters of a splice stay together when another one is made at the same position
+	_, err = doc1.Transact(func(tx Transaction) error {
+		return tx.Splice(text, 5, 6, " there")
+	})
+	assert.Nil(t, err)
+	_, err = doc2.Transact(func(tx Transaction) error {
+		return tx.Splice(text, 5, 0, ", you")
+	})
+	assert.Nil(t, err)
+	doc1.Merge(doc2)
+	doc2.Merge(doc1)
+	str1, _ := doc1.Text(text)
+	str2, _ := doc2.Text(text)
+	assert.Equal(t, str1, str2)
+	assert.Contains(t, []string{"hello there, you", "hello, you there"}, str1)
+}
+
+func TestMarks(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	var text ExOpId
+	_, err := doc1.Transact(func(tx Transaction) error {
+		var err error
+		if text, err = tx.PutObject(ExRootOpId, "note", TEXT); err != nil {
+			return err
+		}
+		return tx.Splice(text, 0, 0, "hello world")
+	})
+	assert.Nil(t, err)
+	doc2 := doc1.Fork()
+
+	_, err = doc1.Transact(func(tx Transaction) error {
+		if err := tx.Mark(text, 0, 5, "bold", true, ExpandAfter); err != nil {
+			return err
+		}
+		return tx.Mark(text, 0, 11, "color", "red", ExpandNone)
+	})
+	assert.Nil(t, err)
+	_, err = doc2.Transact(func(tx Transaction) error {
+		if err := tx.Splice(text, 5, 0, "X"); err != nil {
+			return err
+		}
+		if err := tx.Splice(text, 0, 0, "Y"); err != nil {
+			return err
+		}
+		return tx.Mark(text, 7, 13, "color", "blue", ExpandNone)
+	})
+	assert.Nil(t, err)
+	doc1.Merge(doc2)
+	doc2.Merge(doc1)
+
+	str, _ := doc1.Text(text)
+	assert.Equal(t, "YhelloX world", str)
+	marks1, _ := doc1.Marks(text)
+	marks2, _ := doc2.Marks(text)
+	assert.Equal(t, marks1, marks2)
+	// text inserted at the end of the bold range expands it, text inserted before it doesn't
+	assert.Contains(t, marks1, MarkSpan{Name: "bold", Value: true, Start: 1, End: 7})
+	assert.Equal(t, 3, len(marks1))
+
+	_, err = doc1.Transact(func(tx Transaction) error {
+		return tx.Unmark(text, 2, 4, "bold", ExpandNone)
+	})
+	assert.Nil(t, err)
+	marks1, _ = doc1.Marks(text)
+	assert.Contains(t, marks1, MarkSpan{Name: "bold", Value: true, Start: 1, End: 2})
+	assert.Contains(t, marks1, MarkSpan{Name: "bold", Value: true, Start: 4, End: 7})
+
+	// marks are ordinary operations and survive saving and loading
+	loaded, err := Load(id1, doc1.Save())
+	assert.Nil(t, err)
+	marks, _ := loaded.Marks(text)
+	assert.Equal(t, marks1, marks)
+
+	_, err = doc1.Transact(func(tx Transaction) error {
+		return tx.Mark(text, 3, 3, "bold", true, ExpandNone)
+	})
+	assert.IsType(t, errors.InvalidOperationError{}, err)
+}
+
+func TestCounter(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	var A, B, list ExOpId
+	_, err := doc1.Transact(func(tx Transaction) error {
+		A, _ = tx.PutObject(ExRootOpId, "A", MAP)
+		B, _ = tx.PutObject(ExRootOpId, "B", MAP)
+		list, _ = tx.PutObject(ExRootOpId, "list", LIST)
+		if err := tx.Insert(list, 0, Counter(1)); err != nil {
+			return err
+		}
+		if err := tx.Put(A, "likes", Counter(10)); err != nil {
+			return err
+		}
+		return tx.Increment(A, "likes", 1)
+	})
+	assert.Nil(t, err)
+	doc2 := doc1.Fork()
+
+	// concurrent increments add up
+	_, err = doc1.Transact(func(tx Transaction) error {
+		if err := tx.Increment(list, 0, 2); err != nil {
+			return err
+		}
+		return tx.Increment(A, "likes", 2)
+	})
+	assert.Nil(t, err)
+	_, err = doc2.Transact(func(tx Transaction) error {
+		if err := tx.Increment(list, 0, 3); err != nil {
+			return err
+		}
+		return tx.Increment(A, "likes", -5)
+	})
+	assert.Nil(t, err)
+	doc1.Merge(doc2)
+	doc2.Merge(doc1)
+	for _, doc := range []*Automerge{doc1, doc2} {
+		value, _ := doc.Get(A, "likes")
+		assert.Equal(t, Counter(8), value)
+		value, _ = doc.Get(list, 0)
+		assert.Equal(t, Counter(6), value)
+	}
+
+	// a moved counter keeps its value and can still be incremented
+	_, err = doc1.Transact(func(tx Transaction) error {
+		if err := tx.Move(A, B, "likes", "likes"); err != nil {
+			return err
+		}
+		return tx.Increment(B, "likes", 1)
+	})
+	assert.Nil(t, err)
+	value, _ := doc1.Get(B, "likes")
+	assert.Equal(t, Counter(9), value)
+	_, err = doc1.Get(A, "likes")
+	assert.NotNil(t, err)
+
+	_, err = doc1.Transact(func(tx Transaction) error {
+		_ = tx.Put(A, "name", "x")
+		return tx.Increment(A, "name", 1)
+	})
+	assert.IsType(t, errors.InvalidOperationError{}, err)
+
+	// counters survive both encodings
+	loaded, err := Load(id1, doc1.Save())
+	assert.Nil(t, err)
+	value, _ = loaded.Get(B, "likes")
+	assert.Equal(t, Counter(9), value)
+	id3, _ := uuid.NewRandom()
+	doc3 := NewAutomerge(id3)
+	for _, change := range doc1.history {
+		doc3.MergeFromChangeBytes(change.ToBytes(doc1.ops))
+	}
+	value, _ = doc3.Get(B, "likes")
+	assert.Equal(t, Counter(9), value)
+	value, _ = doc3.Get(list, 0)
+	assert.Equal(t, Counter(6), value)
+}
+
+func TestScalarTypes(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	now := time.Now()
+	expected := map[string]any{
+		"int":       int64(1<<62 + 1),
+		"smallInt":  int64(-3),
+		"uint":      uint64(1<<64 - 1),
+		"float":     1.5,
+		"bool":      true,
+		"string":    "s",
+		"bytes":     []byte{0, 1, 255},
+		"timestamp": time.UnixMilli(now.UnixMilli()).UTC(),
+		"null":      nil,
+		"counter":   Counter(3),
+	}
+	_, err := doc1.Transact(func(tx Transaction) error {
+		for key, value := range expected {
+			if key == "smallInt" {
+				value = int8(-3)
+			} else if key == "timestamp" {
+				value = now
+			}
+			if err := tx.Put(ExRootOpId, key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	_, err = doc1.Transact(func(tx Transaction) error {
+		return tx.Put(ExRootOpId, "struct", struct{}{})
+	})
+	assert.IsType(t, errors.InvalidOperationError{}, err)
+
+	loaded, err := Load(id1, doc1.Save())
+	assert.Nil(t, err)
+	id2, _ := uuid.NewRandom()
+	fromJSON := NewAutomerge(id2)
+	for _, change := range doc1.history {
+		fromJSON.MergeFromChangeBytes(change.ToBytes(doc1.ops))
+	}
+	for _, doc := range []*Automerge{doc1, doc1.Fork(), loaded, fromJSON} {
+		state, _ := doc.Materialize(ExRootOpId)
+		assert.Equal(t, expected, state)
+	}
+}
+
+func TestPatches(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	var received [][]Patch
+	doc1.Subscribe(func(patches []Patch) {
+		received = append(received, patches)
+	})
+	var list, m, text ExOpId
+	_, err := doc1.Transact(func(tx Transaction) error {
+		tx.Put(ExRootOpId, "a", 1)
+		list, _ = tx.PutObject(ExRootOpId, "list", LIST)
+		tx.Insert(list, 0, "x")
+		tx.Insert(list, 1, "y")
+		m, _ = tx.PutObject(ExRootOpId, "m", MAP)
+		text, _ = tx.PutObject(ExRootOpId, "text", TEXT)
+		return tx.Splice(text, 0, 0, "hello")
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Patch{
+		{Action: PatchPut, Obj: ExRootOpId, Key: "a", Value: int64(1)},
+		{Action: PatchPut, Obj: ExRootOpId, Key: "list", Value: list},
+		{Action: PatchPut, Obj: ExRootOpId, Key: "m", Value: m},
+		{Action: PatchPut, Obj: ExRootOpId, Key: "text", Value: text},
+		{Action: PatchInsert, Obj: list, Key: 0, Values: []any{"x", "y"}},
+		{Action: PatchSplice, Obj: text, Key: 0, Text: "hello"},
+	}, received[0])
+
+	_, err = doc1.Transact(func(tx Transaction) error {
+		tx.Delete(list, 0)
+		tx.Splice(text, 1, 3, "ipp")
+		return tx.Move(ExRootOpId, list, "m", 1)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Patch{
+		{Action: PatchDelete, Obj: list, Key: 0, Length: 1},
+		{Action: PatchDelete, Obj: text, Key: 1, Length: 3},
+		{Action: PatchSplice, Obj: text, Key: 1, Text: "ipp"},
+		{Action: PatchMove, Obj: m, OldParent: ExRootOpId, OldKey: "m", NewParent: list, NewKey: 1},
+	}, received[1])
+
+	// concurrent moves of the same object: the replica whose move loses sees the winning move
+	var p, q, c ExOpId
+	doc1.Transact(func(tx Transaction) error {
+		p, _ = tx.PutObject(ExRootOpId, "p", MAP)
+		q, _ = tx.PutObject(ExRootOpId, "q", MAP)
+		c, _ = tx.PutObject(ExRootOpId, "c", MAP)
+		return nil
+	})
+	doc2 := doc1.Fork()
+	var received2 [][]Patch
+	doc2.Subscribe(func(patches []Patch) {
+		received2 = append(received2, patches)
+	})
+	doc1.Transact(func(tx Transaction) error {
+		return tx.Move(ExRootOpId, p, "c", "c")
+	})
+	doc2.Transact(func(tx Transaction) error {
+		return tx.Move(ExRootOpId, q, "c", "c")
+	})
+	assert.Equal(t, []Patch{{Action: PatchMove, Obj: c, OldParent: ExRootOpId, OldKey: "c", NewParent: q, NewKey: "c"}}, received2[0])
+	heads1, heads2 := doc1.GetHeads(), doc2.GetHeads()
+	doc1.ApplyEncodedChanges(doc2.EncodeChanges(doc2.GetChanges(heads1)))
+	doc2.ApplyEncodedChanges(doc1.EncodeChanges(doc1.GetChanges(heads2)))
+	toP := Patch{Action: PatchMove, Obj: c, OldParent: q, OldKey: "c", NewParent: p, NewKey: "c"}
+	toQ := Patch{Action: PatchMove, Obj: c, OldParent: p, OldKey: "c", NewParent: q, NewKey: "c"}
+	if parent, _ := doc1.Get(q, "c"); parent != nil {
+		assert.Equal(t, []Patch{toQ}, received[len(received)-1])
+		assert.Equal(t, []Patch{}, received2[len(received2)-1])
+	} else {
+		assert.Equal(t, []Patch{}, received[len(received)-1])
+		assert.Equal(t, []Patch{toP}, received2[len(received2)-1])
+	}
+
+	// concurrent puts of the same key: both values stay visible, so the merge reports the conflict
+	heads1 = doc1.GetHeads()
+	doc1.Transact(func(tx Transaction) error {
+		return tx.Put(ExRootOpId, "a", 2)
+	})
+	doc2.Transact(func(tx Transaction) error {
+		return tx.Put(ExRootOpId, "a", 3)
+	})
+	doc1.ApplyEncodedChanges(doc2.EncodeChanges(doc2.GetChanges(heads1)))
+	conflict := Patch{Action: PatchConflict, Obj: ExRootOpId, Key: "a", Values: []any{int64(3), int64(2)}}
+	if winner, _ := doc1.Get(ExRootOpId, "a"); winner == int64(3) {
+		conflict.Values = []any{int64(2), int64(3)}
+		assert.Equal(t, []Patch{{Action: PatchPut, Obj: ExRootOpId, Key: "a", Value: int64(3)}, conflict}, received[len(received)-1])
+	} else {
+		assert.Equal(t, []Patch{conflict}, received[len(received)-1])
+	}
+}
+
+func TestDiff(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	var list, a, b ExOpId
+	doc1.Transact(func(tx Transaction) error {
+		list, _ = tx.PutObject(ExRootOpId, "list", LIST)
+		tx.Insert(list, 0, "x")
+		a, _ = tx.InsertObject(list, 1, MAP)
+		b, _ = tx.PutObject(ExRootOpId, "b", MAP)
+		return tx.Put(b, "k", "v")
+	})
+	v1 := doc1.GetHeads()
+	doc1.Transact(func(tx Transaction) error {
+		tx.Put(ExRootOpId, "n", 1)
+		tx.Delete(list, 0)
+		tx.Move(ExRootOpId, ExRootOpId, "b", "renamed")
+		return tx.Move(list, b, 0, "a")
+	})
+	v2 := doc1.GetHeads()
+
+	patches, err := doc1.Diff(v1, v2)
+	assert.Nil(t, err)
+	assert.Equal(t, []Patch{
+		{Action: PatchPut, Obj: ExRootOpId, Key: "n", Value: int64(1)},
+		{Action: PatchDelete, Obj: list, Key: 0, Length: 1},
+		{Action: PatchMove, Obj: a, OldParent: list, OldKey: 0, NewParent: b, NewKey: "a"},
+		{Action: PatchMove, Obj: b, OldParent: ExRootOpId, OldKey: "b", NewParent: ExRootOpId, NewKey: "renamed"},
+	}, patches)
+
+	patches, err = doc1.Diff(v2, v1)
+	assert.Nil(t, err)
+	assert.Equal(t, []Patch{
+		{Action: PatchDelete, Obj: ExRootOpId, Key: "n"},
+		{Action: PatchInsert, Obj: list, Key: 0, Values: []any{"x"}},
+		{Action: PatchMove, Obj: a, OldParent: b, OldKey: "a", NewParent: list, NewKey: 1},
+		{Action: PatchMove, Obj: b, OldParent: ExRootOpId, OldKey: "renamed", NewParent: ExRootOpId, NewKey: "b"},
+	}, patches)
+
+	patches, err = doc1.Diff(v2, v2)
+	assert.Nil(t, err)
+	assert.Equal(t, []Patch{}, patches)
+
+	// the diffs rebuilt the document once at each version, later reads reuse them
+	assert.Equal(t, 2, len(doc1.historyCache))
+	doc1.MaterializeAt(v1, ExRootOpId)
+	assert.Equal(t, 2, len(doc1.historyCache))
+	_, err = doc1.Diff(v1, []ChangeHash{{}})
+	assert.IsType(t, errors.ChangeNotFoundError{}, err)
+}
+
+func TestUndoManager(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	undo := NewUndoManager(doc1)
+	assert.False(t, undo.CanUndo())
+	var list, p, c ExOpId
+	undo.Transact(func(tx Transaction) error {
+		list, _ = tx.PutObject(ExRootOpId, "list", LIST)
+		p, _ = tx.PutObject(ExRootOpId, "p", MAP)
+		c, _ = tx.PutObject(ExRootOpId, "c", MAP)
+		tx.Put(c, "k", "v")
+		tx.Put(ExRootOpId, "n", Counter(1))
+		for i, value := range []string{"x", "y", "z"} {
+			tx.Insert(list, i, value)
+		}
+		return tx.Put(ExRootOpId, "a", 1)
+	})
+	initial, _ := doc1.Materialize(ExRootOpId)
+	undo.Transact(func(tx Transaction) error {
+		tx.Put(ExRootOpId, "a", 2)
+		tx.Delete(list, 1)
+		tx.Put(list, 0, "X")
+		tx.Increment(ExRootOpId, "n", 5)
+		return tx.Move(ExRootOpId, p, "c", "c")
+	})
+	changed, _ := doc1.Materialize(ExRootOpId)
+	assert.Equal(t, map[string]any{
+		"a":    int64(2),
+		"list": []any{"X", "z"},
+		"p":    map[string]any{"c": map[string]any{"k": "v"}},
+		"n":    Counter(6),
+	}, changed)
+
+	assert.Nil(t, undo.Undo())
+	state, _ := doc1.Materialize(ExRootOpId)
+	assert.Equal(t, initial, state)
+	location, _ := doc1.GetDocumentTree()[c]
+	assert.Equal(t, ExRootOpId, location) // moved back, not copied
+	assert.True(t, undo.CanRedo())
+	assert.Nil(t, undo.Redo())
+	state, _ = doc1.Materialize(ExRootOpId)
+	assert.Equal(t, changed, state)
+	assert.Nil(t, undo.Undo())
+	assert.Nil(t, undo.Undo())
+	state, _ = doc1.Materialize(ExRootOpId)
+	assert.Equal(t, map[string]any{}, state)
+	assert.False(t, undo.CanUndo())
+	assert.NotNil(t, undo.Undo())
+	assert.Nil(t, undo.Redo())
+	state, _ = doc1.Materialize(ExRootOpId)
+	assert.Equal(t, initial, state)
+
+	// a deleted object comes back as a copy, and grouped transactions are one step
+	undo.StartGroup()
+	undo.Transact(func(tx Transaction) error {
+		return tx.Delete(ExRootOpId, "c")
+	})
+	undo.Transact(func(tx Transaction) error {
+		return tx.Put(ExRootOpId, "a", 3)
+	})
+	undo.EndGroup()
+	assert.False(t, undo.CanRedo())
+	assert.Nil(t, undo.Undo())
+	state, _ = doc1.Materialize(ExRootOpId)
+	assert.Equal(t, initial, state)
+
+	// undoing closes a group that is still open
+	undo.StartGroup()
+	undo.Transact(func(tx Transaction) error {
+		return tx.Put(ExRootOpId, "a", 3)
+	})
+	undo.Transact(func(tx Transaction) error {
+		return tx.Put(ExRootOpId, "b", 3)
+	})
+	assert.Nil(t, undo.Undo())
+	state, _ = doc1.Materialize(ExRootOpId)
+	assert.Equal(t, initial, state)
+	undo.EndGroup()
+	assert.Nil(t, undo.Redo())
+	a, _ := doc1.Get(ExRootOpId, "a")
+	assert.Equal(t, int64(3), a)
+	assert.Nil(t, undo.Undo())
+
+	// remote edits are kept
+	undo.Transact(func(tx Transaction) error {
+		tx.Put(ExRootOpId, "a", 4)
+		return tx.Put(ExRootOpId, "b", 4)
+	})
+	doc2 := doc1.Fork()
+	doc2.Transact(func(tx Transaction) error {
+		return tx.Put(ExRootOpId, "a", 5)
+	})
+	doc1.ApplyEncodedChanges(doc2.EncodeChanges(doc2.GetChanges(doc1.GetHeads())))
+	assert.Nil(t, undo.Undo())
+	a, _ = doc1.Get(ExRootOpId, "a")
+	assert.Equal(t, int64(5), a)
+	b, _ := doc1.Get(ExRootOpId, "b")
+	assert.Nil(t, b)
+}
+
+func TestCursor(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	var list, other, text, obj ExOpId
+	doc1.Transact(func(tx Transaction) error {
+		list, _ = tx.PutObject(ExRootOpId, "list", LIST)
+		other, _ = tx.PutObject(ExRootOpId, "other", LIST)
+		text, _ = tx.PutObject(ExRootOpId, "text", TEXT)
+		tx.Splice(text, 0, 0, "😀ab")
+		for i, value := range []string{"a", "b", "c"} {
+			tx.Insert(list, i, value)
+		}
+		obj, _ = tx.InsertObject(list, 3, MAP)
+		return nil
+	})
+	cursorB, err := doc1.GetCursor(list, 1)
+	assert.Nil(t, err)
+	cursorObj, _ := doc1.GetCursor(list, 3)
+	cursorText, _ := doc1.GetCursor(text, 2)
+	_, err = doc1.GetCursor(list, 4)
+	assert.IsType(t, errors.ListIndexExceedsLengthError{}, err)
+
+	// concurrent inserts before the element shift it
+	doc2 := doc1.Fork()
+	doc2.Transact(func(tx Transaction) error {
+		tx.Insert(list, 0, "x")
+		return tx.Splice(text, 0, 0, "y")
+	})
+	doc1.Transact(func(tx Transaction) error {
+		return tx.Insert(list, 0, "z")
+	})
+	doc1.ApplyEncodedChanges(doc2.EncodeChanges(doc2.GetChanges(doc1.GetHeads())))
+	obj1, index, err := doc1.ResolveCursor(cursorB)
+	assert.Nil(t, err)
+	assert.Equal(t, list, obj1)
+	assert.Equal(t, 3, index)
+	_, index, _ = doc1.ResolveCursor(cursorText)
+	assert.Equal(t, 3, index)
+
+	// moved elements are followed, deleted ones are reported
+	doc1.Transact(func(tx Transaction) error {
+		tx.Move(list, other, 5, 0)
+		return tx.Move(list, other, 3, 1)
+	})
+	obj1, index, err = doc1.ResolveCursor(cursorObj)
+	assert.Nil(t, err)
+	assert.Equal(t, other, obj1)
+	assert.Equal(t, 0, index)
+	obj1, index, err = doc1.ResolveCursor(cursorB)
+	assert.Nil(t, err)
+	assert.Equal(t, other, obj1)
+	assert.Equal(t, 1, index)
+	value, _ := doc1.Get(other, 0)
+	assert.Equal(t, obj, value)
+	doc1.Transact(func(tx Transaction) error {
+		return tx.Delete(other, 1)
+	})
+	_, _, err = doc1.ResolveCursor(cursorB)
+	assert.IsType(t, errors.ElementDeletedError{}, err)
+}
+
+func TestPaths(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc1 := NewAutomerge(id1)
+	var student ExOpId
+	_, err := doc1.Transact(func(tx Transaction) error {
+		students, err := tx.PutObjectPath("students", LIST)
+		if err != nil {
+			return err
+		}
+		tx.InsertObject(students, 0, MAP)
+		if student, err = tx.PutObjectPath([]any{"students", 0, "info"}, MAP); err != nil {
+			return err
+		}
+		tx.PutPath("students/0/name", "Alice")
+		tx.PutObjectPath("a~1b", MAP)
+		return tx.PutPath([]any{"students", 0, "info", "age"}, 22)
+	})
+	assert.Nil(t, err)
+
+	name, err := doc1.GetPath("students/0/name")
+	assert.Nil(t, err)
+	assert.Equal(t, "Alice", name)
+	age, _ := doc1.GetPath([]any{"students", 0, "info", "age"})
+	assert.Equal(t, int64(22), age)
+	root, _ := doc1.GetPath("")
+	assert.Equal(t, ExRootOpId, root)
+	_, err = doc1.GetPath("students/x")
+	assert.IsType(t, errors.InvalidOperationError{}, err)
+	_, err = doc1.GetPath("students/0/name/first")
+	assert.IsType(t, errors.InvalidOperationError{}, err)
+	slash, _ := doc1.Keys(ExRootOpId)
+	assert.Contains(t, slash, "a/b")
+
+	// empty properties are segments, too
+	doc1.Transact(func(tx Transaction) error {
+		tx.PutObjectPath("/", MAP)
+		return tx.PutPath("//x", "empty")
+	})
+	empty, _ := doc1.GetPath([]any{"", "x"})
+	assert.Equal(t, "empty", empty)
+	empty, _ = doc1.GetPath("/students/0/name")
+	assert.Equal(t, "Alice", empty)
+	_, err = doc1.GetPath("students/0/")
+	assert.IsType(t, errors.PropertyNotFoundError{}, err)
+
+	path, err := doc1.PathOf(student)
+	assert.Nil(t, err)
+	assert.Equal(t, []any{"students", 0, "info"}, path)
+	doc1.Transact(func(tx Transaction) error {
+		students, _ := tx.Get(ExRootOpId, "students")
+		tx.InsertObject(students.(ExOpId), 0, MAP)
+		return tx.Move(students.(ExOpId), ExRootOpId, 1, "moved")
+	})
+	path, _ = doc1.PathOf(student)
+	assert.Equal(t, []any{"moved", "info"}, path)
+	doc1.Transact(func(tx Transaction) error {
+		return tx.Delete(ExRootOpId, "moved")
+	})
+	_, err = doc1.PathOf(student)
+	assert.NotNil(t, err)
+}
+
+func TestLargeListConsistency(t *testing.T) {
+	random := rand.New(rand.NewSource(42))
+	id, _ := uuid.NewRandom()
+	doc := NewAutomerge(id)
+	tx := doc.StartTransaction()
+	list, _ := tx.PutObject(ExRootOpId, "list", opset.LIST)
+	for i := 0; i < 300; i++ {
+		tx.Insert(list, i, strconv.Itoa(i))
+	}
+	doc.CommitTransaction()
+
+	// the visible counts of the op storage must agree with a scan of all operations
+	check := func(doc *Automerge) {
+		state, _ := doc.Materialize(list)
+		elements := state.([]any)
+		length, _ := doc.Length(list)
+		assert.Equal(t, len(elements), length)
+		for i, element := range elements {
+			value, _ := doc.Get(list, i)
+			assert.Equal(t, element, value)
+		}
+	}
+
+	docs := []*Automerge{doc, doc.Fork(), doc.Fork()}
+	for round := 0; round < 10; round++ {
+		for d, doc := range docs {
+			for i := 0; i < 30; i++ {
+				length, _ := doc.Length(list)
+				doc.Transact(func(tx Transaction) error {
+					switch op := random.Intn(4); {
+					case op == 0 || length < 2:
+						return tx.Insert(list, random.Intn(length+1), strconv.Itoa(round)+"-"+strconv.Itoa(d)+"-"+strconv.Itoa(i))
+					case op == 1:
+						return tx.Delete(list, random.Intn(length))
+					case op == 2:
+						return tx.Put(list, random.Intn(length), strconv.Itoa(i))
+					default:
+						return tx.Move(list, list, random.Intn(length), random.Intn(length))
+					}
+				})
+			}
+			check(doc)
+		}
+		for _, doc := range docs {
+			for _, other := range docs {
+				if doc != other {
+					doc.Merge(other)
+				}
+			}
+			check(doc)
+		}
+	}
+	expected, _ := docs[0].Materialize(ExRootOpId)
+	for _, doc := range docs[1:] {
+		state, _ := doc.Materialize(ExRootOpId)
+		assert.Equal(t, expected, state)
+	}
+}
+
+func TestLargeRollbackAndTextPositions(t *testing.T) {
+	id, _ := uuid.NewRandom()
+	doc := NewAutomerge(id)
+	doc.SetTextEncoding(UTF16)
+	tx := doc.StartTransaction()
+	list, _ := tx.PutObject(ExRootOpId, "list", opset.LIST)
+	text, _ := tx.PutObject(ExRootOpId, "text", opset.TEXT)
+	for i := 0; i < 500; i++ {
+		tx.Insert(list, i, strconv.Itoa(i))
+	}
+	doc.CommitTransaction()
+	before, _ := doc.Materialize(list)
+
+	// rolling back a large transaction empties leaves, which are merged with their siblings
+	tx = doc.StartTransaction()
+	for i := 0; i < 1000; i++ {
+		tx.Insert(list, 250, "new")
+	}
+	for i := 0; i < 400; i++ {
+		tx.Delete(list, 0)
+	}
+	doc.RollbackTransaction()
+	after, _ := doc.Materialize(list)
+	assert.Equal(t, before, after)
+	for _, index := range []int{0, 63, 64, 250, 499} {
+		value, _ := doc.Get(list, index)
+		assert.Equal(t, strconv.Itoa(index), value)
+	}
+
+	// positions in texts are found from the widths counted in the op storage
+	tx = doc.StartTransaction()
+	for i := 0; i < 200; i++ {
+		tx.Splice(text, 3*i, 0, "a😀")
+	}
+	doc.CommitTransaction()
+	length, _ := doc.Length(text)
+	assert.Equal(t, 600, length)
+	tx = doc.StartTransaction()
+	assert.NotNil(t, tx.Splice(text, 299, 1, ""))
+	assert.Nil(t, tx.Splice(text, 300, 3, "b"))
+	doc.CommitTransaction()
+	content, _ := doc.Text(text)
+	assert.Equal(t, strings.Repeat("a😀", 100)+"b"+strings.Repeat("a😀", 99), content)
+	cursor, _ := doc.GetCursor(text, 301)
+	_, position, _ := doc.ResolveCursor(cursor)
+	assert.Equal(t, 301, position)
+}
+
+func TestKeyRanges(t *testing.T) {
+	id1, _ := uuid.NewRandom()
+	doc := NewAutomerge(id1)
+	tx := doc.StartTransaction()
+	index, _ := tx.PutObject(ExRootOpId, "index", opset.MAP)
+	for i := 0; i < 2000; i++ {
+		tx.Put(index, "user:"+strconv.Itoa(i), int64(i))
+	}
+	tx.Put(index, "group:admins", "1")
+	tx.Delete(index, "user:1000")
+	doc.CommitTransaction()
+
+	value, err := doc.Get(index, "user:1999")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1999), value)
+	length, _ := doc.Length(index)
+	assert.Equal(t, 2000, length)
+
+	inRange, err := doc.KeysInRange(index, "user:100", "user:1002")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user:100", "user:1001"}, inRange)
+	inRange, _ = doc.KeysInRange(index, "user:998", "")
+	assert.Equal(t, []string{"user:998", "user:999"}, inRange)
+	inRange, _ = doc.KeysInRange(index, "a", "b")
+	assert.Empty(t, inRange)
+
+	prefixed, err := doc.KeysWithPrefix(index, "user:199")
+	assert.Nil(t, err)
+	assert.Len(t, prefixed, 11)
+	assert.Equal(t, "user:199", prefixed[0])
+	prefixed, _ = doc.KeysWithPrefix(index, "group:")
+	assert.Equal(t, []string{"group:admins"}, prefixed)
+	all, _ := doc.Keys(index)
+	assert.Len(t, all, 2000)
+
+	// concurrent writes to the same keys merge into the sorted index
+	doc2 := doc.Fork()
+	tx = doc2.StartTransaction()
+	tx.Put(index, "user:5", "other")
+	tx.Put(index, "user:1000", "back")
+	doc2.CommitTransaction()
+	tx = doc.StartTransaction()
+	tx.Put(index, "user:5", "mine")
+	doc.CommitTransaction()
+	doc.Merge(doc2)
+	doc2.Merge(doc)
+	value1, _ := doc.Get(index, "user:5")
+	value2, _ := doc2.Get(index, "user:5")
+	assert.Equal(t, value1, value2)
+	inRange, _ = doc.KeysInRange(index, "user:1000", "user:1001")
+	assert.Equal(t, []string{"user:1000"}, inRange)
+
+	_, err = doc.KeysInRange(ExRootOpId, "", "")
+	assert.Nil(t, err)
+	list, _ := doc.Transact(func(tx Transaction) error {
+		_, err := tx.PutObject(ExRootOpId, "list", opset.LIST)
+		return err
+	})
+	assert.NotNil(t, list)
+	listId, _ := doc.Get(ExRootOpId, "list")
+	_, err = doc.KeysWithPrefix(listId.(ExOpId), "a")
+	assert.Equal(t, errors.InvalidOperationError{Reason: "cannot get keys of a list"}, err)
+}
+
+func TestBatchedApplyChanges(t *testing.T) {
+	random := rand.New(rand.NewSource(7))
+	id, _ := uuid.NewRandom()
+	doc := NewAutomerge(id)
+	tx := doc.StartTransaction()
+	objects := make([]ExOpId, 0)
+	for _, key := range []string{"A", "B", "C", "D"} {
+		object, _ := tx.PutObject(ExRootOpId, key, opset.MAP)
+		tx.Put(object, "name", key)
+		objects = append(objects, object)
+	}
+	list, _ := tx.PutObject(ExRootOpId, "list", opset.LIST)
+	for i := 0; i < 20; i++ {
+		tx.Insert(list, i, strconv.Itoa(i))
+	}
+	doc.CommitTransaction()
+
+	// every actor makes concurrent changes with moves that conflict with those of the others
+	encoded := forkChanges(doc, 4, func(actor int, fork *Automerge) {
+		for i := 0; i < 15; i++ {
+			fork.Transact(func(tx Transaction) error {
+				for j := 0; j < 1+random.Intn(3); j++ {
+					switch random.Intn(4) {
+					case 0:
+						_ = tx.MoveObject(objects[random.Intn(len(objects))], objects[random.Intn(len(objects))])
+					case 1:
+						_ = tx.Move(list, list, random.Intn(20), random.Intn(20))
+					case 2:
+						_ = tx.Put(list, random.Intn(20), strconv.Itoa(actor))
+					default:
+						_ = tx.Put(objects[random.Intn(len(objects))], "name", strconv.Itoa(actor))
+					}
+				}
+				return nil
+			})
+		}
+	})
+
+	// deliver the changes of the actors interleaved, so that late moves revert later ones
+	interleave := func(target *Automerge) []*Change {
+		decoded, err := decodeForkChanges(target, encoded)
+		assert.Nil(t, err)
+		changes := make([]*Change, 0)
+		for i := 0; i < 15; i++ {
+			for _, actorChanges := range decoded {
+				changes = append(changes, actorChanges[i])
+			}
+		}
+		return changes
+	}
+	batched := doc.Fork()
+	changes := interleave(batched)
+	assert.Len(t, batched.ApplyChanges(changes), len(changes))
+	oneByOne := doc.Fork()
+	for _, change := range interleave(oneByOne) {
+		assert.Len(t, oneByOne.ApplyChanges([]*Change{change}), 1)
+	}
+	// changes that aren't causally ready wait in the queue and are applied in the same batch
+	reversed := doc.Fork()
+	changes = interleave(reversed)
+	for i, j := 0, len(changes)-1; i < j; i, j = i+1, j-1 {
+		changes[i], changes[j] = changes[j], changes[i]
+	}
+	assert.Len(t, reversed.ApplyChanges(changes), len(changes))
+
+	expected, _ := oneByOne.Materialize(ExRootOpId)
+	for _, other := range []*Automerge{batched, reversed} {
+		state, _ := other.Materialize(ExRootOpId)
+		assert.Equal(t, expected, state)
+		assert.Equal(t, oneByOne.GetDocumentTree(), other.GetDocumentTree())
+		assert.ElementsMatch(t, oneByOne.GetHeads(), other.GetHeads())
+	}
+}
+
+func TestMoveLogCheckpoints(t *testing.T) {
+	defer func(interval int) { opset.MoveCheckpointInterval = interval }(opset.MoveCheckpointInterval)
+	doc, encoded := concurrentMoves(2, 50)
+
+	// a peer that hasn't seen the moves of the forks keeps them in the log
+	peer := doc.Fork()
+	peer.Transact(func(tx Transaction) error {
+		return tx.Put(ExRootOpId, "peer", true)
+	})
+
+	// the moves of the second fork interleave with those of the first, so they undo most of them
+	apply := func(interval int) *Automerge {
+		opset.MoveCheckpointInterval = interval
+		target := doc.Fork()
+		target.Merge(peer)
+		for _, changes := range encoded {
+			_, err := target.ApplyEncodedChanges(changes)
+			assert.Nil(t, err)
+		}
+		return target
+	}
+	withoutCheckpoints := apply(0)
+	stats := withoutCheckpoints.MoveLogStats()
+	assert.Greater(t, stats.LastReverts, 40)
+	assert.Equal(t, 0, stats.Checkpoints)
+	assert.Equal(t, 0, stats.Restores)
+
+	// the checkpoint after the moves of the document is the latest one before the undone moves
+	withCheckpoints := apply(5)
+	stats = withCheckpoints.MoveLogStats()
+	assert.Greater(t, stats.LastReverts, 40)
+	assert.Greater(t, stats.Checkpoints, 0)
+	assert.Equal(t, 1, stats.Restores)
+	expected, _ := withoutCheckpoints.Materialize(ExRootOpId)
+	state, _ := withCheckpoints.Materialize(ExRootOpId)
+	assert.Equal(t, expected, state)
+}
+
+func TestMoveLogTruncation(t *testing.T) {
+	id1 := uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	id2 := uuid.MustParse("00000000-0000-0000-0000-000000000002")
+	id3 := uuid.MustParse("00000000-0000-0000-0000-000000000003")
+	id4 := uuid.MustParse("00000000-0000-0000-0000-000000000004")
+	doc1 := NewAutomerge(id1)
+	var list ExOpId
+	doc1.Transact(func(tx Transaction) error {
+		list, _ = tx.PutObject(ExRootOpId, "list", opset.LIST)
+		for i := 0; i < 20; i++ {
+			tx.Insert(list, i, strconv.Itoa(i))
+		}
+		return nil
+	})
+	moves := func(doc *Automerge, n int) {
+		for i := 0; i < n; i++ {
+			doc.Transact(func(tx Transaction) error {
+				return tx.Move(list, list, i%20, (i*7)%20)
+			})
+		}
+	}
+	doc2 := NewAutomerge(id2)
+	doc2.Merge(doc1)
+	doc3 := NewAutomerge(id3)
+	doc3.Merge(doc1)
+	moves(doc3, 3)
+
+	// doc2 hasn't seen the moves of doc1 yet, so they stay in the log
+	doc2.Transact(func(tx Transaction) error {
+		return tx.Put(ExRootOpId, "doc2", true)
+	})
+	doc1.Merge(doc2)
+	moves(doc1, 50)
+	stats := doc1.MoveLogStats()
+	assert.Equal(t, 50, stats.LogLength)
+	assert.Equal(t, 0, stats.Truncated)
+
+	// a change of doc2 that depends on the moves acknowledges them
+	doc2.Merge(doc1)
+	doc2.Transact(func(tx Transaction) error {
+		return tx.Put(ExRootOpId, "doc2", false)
+	})
+	doc1.Merge(doc2)
+	stats = doc1.MoveLogStats()
+	assert.Equal(t, 0, stats.LogLength)
+	assert.Equal(t, 50, stats.Truncated)
+
+	// only the winning move of every element and the clocks of the heads are kept
+	assert.LessOrEqual(t, stats.Tracked, 20)
+	assert.Equal(t, len(doc1.GetHeads()), len(doc1.clocks))
+
+	// a fork that is created later depends on the truncated moves, too
+	doc4 := NewAutomerge(id4)
+	doc4.Merge(doc2)
+	moves(doc4, 5)
+	doc1.Merge(doc4)
+	stats = doc1.MoveLogStats()
+	assert.Equal(t, 0, stats.Replays)
+	assert.Equal(t, 0, stats.LastReverts)
+	assert.Equal(t, 5, stats.LogLength)
+
+	// doc3 was unknown when the log was truncated, so its concurrent moves go back to the frontier
+	// and redo only the moves after it
+	doc1.Merge(doc3)
+	stats = doc1.MoveLogStats()
+	assert.Equal(t, 1, stats.Replays)
+	assert.Equal(t, 5, stats.LastReverts)
+	doc3.Merge(doc1)
+	expected, _ := doc3.Materialize(ExRootOpId)
+	state, _ := doc1.Materialize(ExRootOpId)
+	assert.Equal(t, expected, state)
+}
+
+// forkChanges lets forks of doc make changes with edit and returns the encoded changes of every fork
+func forkChanges(doc *Automerge, forks int, edit func(fork int, doc *Automerge)) [][]byte {
+	encoded := make([][]byte, 0, forks)
+	for i := 0; i < forks; i++ {
+		fork := doc.Fork()
+		edit(i, fork)
+		encoded = append(encoded, fork.EncodeChanges(fork.GetChanges(doc.GetHeads())))
+	}
+	return encoded
+}
+
+// decodeForkChanges decodes the changes returned by forkChanges for doc
+func decodeForkChanges(doc *Automerge, encoded [][]byte) ([][]*Change, error) {
+	decoded := make([][]*Change, 0, len(encoded))
+	for _, bytes := range encoded {
+		changes, err := transaction.DecodeChanges(bytes, doc.ops)
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, changes)
+	}
+	return decoded, nil
+}
+
+// concurrentMoves returns a document and the encoded concurrent changes of several actors that move
+// the elements of a list around, so that applying them compares many OpIds with equal counters and
+// undoes and redoes the move log for every actor. The document makes moves before it is forked, so
+// undoing the moves of the forks never empties the log.
+func concurrentMoves(actors int, moves int) (*Automerge, [][]byte) {
+	id, _ := uuid.NewRandom()
+	doc := NewAutomerge(id)
+	tx := doc.StartTransaction()
+	list, _ := tx.PutObject(ExRootOpId, "list", opset.LIST)
+	for i := 0; i < 100; i++ {
+		tx.Insert(list, i, strconv.Itoa(i))
+	}
+	doc.CommitTransaction()
+	move := func(doc *Automerge, actor int) {
+		for i := 0; i < moves; i++ {
+			doc.Transact(func(tx Transaction) error {
+				return tx.Move(list, list, (actor+i)%100, (actor*7+i*3)%100)
+			})
+		}
+	}
+	move(doc, actors)
+
+	encoded := forkChanges(doc, actors, func(actor int, fork *Automerge) {
+		move(fork, actor)
+	})
+	return doc, encoded
+}
+
+// BenchmarkOpIdGreaterThan compares OpIds with equal counters, which are ordered by their actors
+func BenchmarkOpIdGreaterThan(b *testing.B) {
+	id, _ := uuid.NewRandom()
+	doc := NewAutomerge(id)
+	ids := make([]opset.OpId, 0, 64)
+	for i := 0; i < 64; i++ {
+		actor, _ := uuid.NewRandom()
+		ids = append(ids, opset.OpId{ActorId: doc.ops.GetIdx(actor), Counter: 1})
+	}
+	b.ResetTimer()
+	greater := 0
+	for i := 0; i < b.N; i++ {
+		if ids[i%64].GreaterThan(doc.ops, &ids[(i+1)%64]) {
+			greater++
+		}
+	}
+}
+
+func BenchmarkBulkUpdateValidity(b *testing.B) {
+	defer SetLogLevel(logrus.GetLevel())
+	SetLogLevel(logrus.WarnLevel)
+	doc, encoded := concurrentMoves(8, 50)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fork := doc.Fork()
+		decoded, _ := decodeForkChanges(fork, encoded)
+		b.StartTimer()
+		for _, changes := range decoded {
+			fork.ApplyChanges(changes)
+		}
+	}
+}
+
+func BenchmarkListSeekOperation(b *testing.B) {
+	defer SetLogLevel(logrus.GetLevel())
+	SetLogLevel(logrus.WarnLevel)
+	id, _ := uuid.NewRandom()
+	doc := NewAutomerge(id)
+	tx := doc.StartTransaction()
+	list, _ := tx.PutObject(ExRootOpId, "list", opset.LIST)
+	doc.CommitTransaction()
+
+	// concurrent inserts at the head of the list become siblings that are ordered by their OpIds
+	encoded := forkChanges(doc, 20, func(actor int, fork *Automerge) {
+		for i := 0; i < 50; i++ {
+			fork.Transact(func(tx Transaction) error {
+				return tx.Insert(list, 0, strconv.Itoa(i))
+			})
+		}
+	})
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fork := doc.Fork()
+		decoded, _ := decodeForkChanges(fork, encoded)
+		b.StartTimer()
+		for _, changes := range decoded {
+			fork.ApplyChanges(changes)
+		}
+	}
+}
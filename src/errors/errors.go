@@ -18,6 +18,22 @@ func (e ListIndexExceedsLengthError) Error() string {
 	return fmt.Sprintf("List index %v exceeds length", e.Index)
 }
 
+type ObjectNotFoundError struct {
+	ObjId string
+}
+
+func (e ObjectNotFoundError) Error() string {
+	return fmt.Sprintf("Object %v not found", e.ObjId)
+}
+
+type ChangeNotFoundError struct {
+	Hash string
+}
+
+func (e ChangeNotFoundError) Error() string {
+	return fmt.Sprintf("Change %v not found", e.Hash)
+}
+
 type InvalidOperationError struct {
 	Reason string
 }
@@ -26,9 +42,25 @@ func (e InvalidOperationError) Error() string {
 	return fmt.Sprintf("Invalid operation: %v", e.Reason)
 }
 
+type DecodeError struct {
+	Reason string
+}
+
+func (e DecodeError) Error() string {
+	return fmt.Sprintf("Cannot decode: %v", e.Reason)
+}
+
 type UnknownError struct {
 }
 
 func (e UnknownError) Error() string {
 	return fmt.Sprintf("Unknown error")
 }
+
+type ElementDeletedError struct {
+	ElemId string
+}
+
+func (e ElementDeletedError) Error() string {
+	return fmt.Sprintf("Element %v is deleted", e.ElemId)
+}
@@ -0,0 +1,197 @@
+package automergeproto
+
+import (
+	"encoding/hex"
+	"github.com/LiangrunDa/AutomergeWithMove/errors"
+	"github.com/LiangrunDa/AutomergeWithMove/internal/opset"
+	"github.com/google/uuid"
+	"strings"
+)
+
+// historyCacheSize is the number of OpSets at past heads a document keeps for further reads
+const historyCacheSize = 8
+
+type historicalOpSet struct {
+	key string // the heads of the covered changes
+	ops *OpSet
+}
+
+// opSetAt rebuilds the OpSet from the changes in the causal past of heads, so that both the
+// visibility of operations and the validity of moves are evaluated as they were at that point.
+// Rebuilding replays the history, so the latest OpSets are cached. The causal past of heads never
+// changes, so they never become stale. Callers must not modify the returned OpSet.
+func (a *Automerge) opSetAt(heads []ChangeHash) (*OpSet, error) {
+	for _, head := range heads {
+		if _, ok := a.historyIndex[head]; !ok {
+			return nil, errors.ChangeNotFoundError{Hash: hex.EncodeToString(head[:])}
+		}
+	}
+	return a.opSetCovering(a.ancestors(heads)), nil
+}
+
+// opSetCovering returns the OpSet of a causally closed set of changes, see opSetAt
+func (a *Automerge) opSetCovering(covered map[ChangeHash]bool) *OpSet {
+	key := a.coveredKey(covered)
+	a.historyCacheLock.Lock()
+	defer a.historyCacheLock.Unlock()
+	for i, cached := range a.historyCache {
+		if cached.key == key {
+			a.historyCache = append(append(a.historyCache[:i:i], a.historyCache[i+1:]...), cached)
+			return cached.ops
+		}
+	}
+
+	ops := opset.NewOpSet(a.actorId)
+	ops.SetTextEncoding(a.ops.TextEncoding())
+	for _, change := range a.history {
+		// register all actors in history order, so that OpSets at different heads agree on OpIds
+		ops.GetIdx(change.ActorId)
+	}
+	for _, change := range a.history {
+		if !covered[change.Hash()] {
+			continue
+		}
+		operations := make([]*Operation, 0, len(change.Operations))
+		for _, op := range change.Operations {
+			operations = append(operations, op.Copy(a.ops, ops))
+		}
+		for _, op := range operations {
+			ops.InsertOperation(op)
+		}
+		ops.BulkUpdateValidity(operations)
+	}
+	a.historyCache = append(a.historyCache, historicalOpSet{key: key, ops: ops})
+	if len(a.historyCache) > historyCacheSize {
+		a.historyCache = a.historyCache[1:]
+	}
+	return ops
+}
+
+// coveredKey identifies a causally closed set of changes by the ones no other change in it depends
+// on, so that heads with redundant ancestors share an OpSet
+func (a *Automerge) coveredKey(covered map[ChangeHash]bool) string {
+	depended := map[ChangeHash]bool{}
+	for hash := range covered {
+		for _, dep := range a.history[a.historyIndex[hash]].Dependencies {
+			depended[dep] = true
+		}
+	}
+	heads := make([]ChangeHash, 0)
+	for hash := range covered {
+		if !depended[hash] {
+			heads = append(heads, hash)
+		}
+	}
+	sortHashes(heads)
+	var key strings.Builder
+	for _, head := range heads {
+		key.Write(head[:])
+	}
+	return key.String()
+}
+
+// ForkAt returns a new document with a random actor id that contains only the causal past of heads
+func (a *Automerge) ForkAt(heads []ChangeHash) (*Automerge, error) {
+	id, _ := uuid.NewRandom()
+	doc := NewAutomerge(id)
+	doc.SetTextEncoding(a.TextEncoding())
+	a.lock.RLock()
+	for _, head := range heads {
+		if _, ok := a.historyIndex[head]; !ok {
+			a.lock.RUnlock()
+			return nil, errors.ChangeNotFoundError{Hash: hex.EncodeToString(head[:])}
+		}
+	}
+	covered := a.ancestors(heads)
+	changes := make([]*Change, 0, len(covered))
+	for _, change := range a.history {
+		if covered[change.Hash()] {
+			changes = append(changes, change.Copy(a.ops, doc.ops))
+		}
+	}
+	a.lock.RUnlock()
+	doc.ApplyChanges(changes)
+	return doc, nil
+}
+
+// readAt looks up objId in the OpSet at heads and runs read on it
+func (a *Automerge) readAt(heads []ChangeHash, objId ExOpId, read func(ops *OpSet, id OpId) (any, error)) (any, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	ops, err := a.opSetAt(heads)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := objId.Lookup(ops)
+	if !ok {
+		return nil, errors.ObjectNotFoundError{ObjId: objId.String()}
+	}
+	return read(ops, id)
+}
+
+// GetAt returns the value of a property or list element as it was at the given heads
+func (a *Automerge) GetAt(heads []ChangeHash, objId ExOpId, propertyOrIndex any) (any, error) {
+	return a.readAt(heads, objId, func(ops *OpSet, id OpId) (any, error) {
+		res, err := ops.Get(id, propertyOrIndex)
+		return ops.ToExValue(res), err
+	})
+}
+
+// MaterializeAt returns the state of an object as it was at the given heads
+func (a *Automerge) MaterializeAt(heads []ChangeHash, objId ExOpId) (any, error) {
+	return a.readAt(heads, objId, func(ops *OpSet, id OpId) (any, error) {
+		return ops.Materialize(id)
+	})
+}
+
+// KeysAt returns the properties of a map as they were at the given heads
+func (a *Automerge) KeysAt(heads []ChangeHash, objId ExOpId) ([]string, error) {
+	keys, err := a.readAt(heads, objId, func(ops *OpSet, id OpId) (any, error) {
+		return ops.Keys(id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys.([]string), nil
+}
+
+// LengthAt returns the length of a map or list as it was at the given heads
+func (a *Automerge) LengthAt(heads []ChangeHash, objId ExOpId) (int, error) {
+	length, err := a.readAt(heads, objId, func(ops *OpSet, id OpId) (any, error) {
+		return ops.Length(id)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return length.(int), nil
+}
+
+// Diff returns the patches that turn the visible state at the heads before into the one at the heads
+// after. Objects whose winning move changed are reported with a move patch.
+func (a *Automerge) Diff(before []ChangeHash, after []ChangeHash) ([]Patch, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	for _, head := range append(append([]ChangeHash{}, before...), after...) {
+		if _, ok := a.historyIndex[head]; !ok {
+			return nil, errors.ChangeNotFoundError{Hash: hex.EncodeToString(head[:])}
+		}
+	}
+	coveredBefore, coveredAfter := a.ancestors(before), a.ancestors(after)
+	beforeOps, afterOps := a.opSetCovering(coveredBefore), a.opSetCovering(coveredAfter)
+
+	// usually one side is in the past of the other one, then the union is that side
+	union := map[ChangeHash]bool{}
+	for hash := range coveredBefore {
+		union[hash] = true
+	}
+	for hash := range coveredAfter {
+		union[hash] = true
+	}
+	unionOps := afterOps
+	if len(union) == len(coveredBefore) {
+		unionOps = beforeOps
+	} else if len(union) != len(coveredAfter) {
+		unionOps = a.opSetCovering(union)
+	}
+	return opset.Diff(beforeOps, afterOps, unionOps), nil
+}
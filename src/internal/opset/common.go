@@ -7,6 +7,8 @@ const (
 	DELETE
 	PUT
 	MOVE
+	MARK
+	INCREMENT
 )
 
 func (actionType ActionType) String() string {
@@ -19,6 +21,10 @@ func (actionType ActionType) String() string {
 		return "PUT"
 	case MOVE:
 		return "MOVE"
+	case MARK:
+		return "MARK"
+	case INCREMENT:
+		return "INCREMENT"
 	}
 	return ""
 }
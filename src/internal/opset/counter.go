@@ -0,0 +1,131 @@
+package opset
+
+import "github.com/LiangrunDa/AutomergeWithMove/errors"
+
+// Counter is a number that merges concurrent changes by adding them up instead of letting the last
+// write win. It is put like any other scalar value and changed by INCREMENT operations, which name
+// the counter operations they apply to as predecessors but don't overwrite them.
+type Counter int64
+
+// addSuccessorOp records succ as successor of op, or as one of its increments
+func (op *Operation) addSuccessorOp(succ *Operation) {
+	if succ.Action == INCREMENT {
+		op.addIncrement(succ)
+	} else {
+		op.addSuccessor(succ.OpId.Id)
+	}
+}
+
+func (op *Operation) addIncrement(increment *Operation) {
+	for _, inc := range op.increments {
+		if inc.OpId.Id == increment.OpId.Id {
+			return
+		}
+	}
+	op.increments = append(op.increments, increment)
+}
+
+func (op *Operation) removeIncrement(increment *Operation) {
+	for i, inc := range op.increments {
+		if inc == increment {
+			op.increments = append(op.increments[:i], op.increments[i+1:]...)
+			if len(op.increments) == 0 {
+				op.increments = nil
+			}
+			return
+		}
+	}
+}
+
+// withIncrements adds the increments applied to op to value, if it is a counter
+func (op *Operation) withIncrements(value any) any {
+	if counter, ok := value.(Counter); ok {
+		for _, inc := range op.increments {
+			counter += Counter(inc.Value.(int64))
+		}
+		return counter
+	}
+	return value
+}
+
+// valueWithout is the visible value of an operation without the given increments
+func (op *Operation) valueWithout(increments map[OpId]bool) (any, bool) {
+	value, isObject := op.visibleValue()
+	if counter, ok := op.Value.(Counter); ok {
+		for _, inc := range op.increments {
+			if !increments[inc.OpId.Id] {
+				counter += Counter(inc.Value.(int64))
+			}
+		}
+		value = counter
+	}
+	return value, isObject
+}
+
+// removeIncrement removes increment from the counters it applies to, which are its predecessors
+func (opt *OpTree) removeIncrement(increment *Operation) {
+	for _, pred := range increment.Pred {
+		if op := opt.ops.findOperation(opt.ObjId, pred); op != nil {
+			op.removeIncrement(increment)
+		}
+	}
+}
+
+// Increment adds delta to the counter at a property of a map or an element of a list
+func (s *OpSet) Increment(objId OpId, propertyOrIndex any, delta int64) error {
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return err
+	}
+	var operations []*Operation
+	var insertIdx int
+	var prop any
+	if tree.Type == MAP {
+		property, ok := propertyOrIndex.(string)
+		if !ok {
+			return errors.InvalidOperationError{Reason: "cannot increment index on a map"}
+		}
+		if operations, insertIdx = tree.search(property); len(operations) == 0 {
+			return errors.PropertyNotFoundError{PropertyName: property}
+		}
+		prop = property
+	} else {
+		index, ok := propertyOrIndex.(int)
+		if !ok {
+			return errors.InvalidOperationError{Reason: "cannot increment property on a list"}
+		}
+		if operations, insertIdx = tree.nth(index); len(operations) == 0 {
+			return errors.ListIndexExceedsLengthError{Index: index}
+		}
+		prop = operations[0].elementId()
+	}
+
+	counters := make([]*Operation, 0)
+	pred := make([]OpId, 0)
+	for _, op := range operations {
+		if value, _ := op.visibleValue(); value != nil {
+			if _, ok := value.(Counter); ok {
+				counters = append(counters, op)
+				pred = append(pred, op.OpId.Id)
+			}
+		}
+	}
+	if len(counters) == 0 {
+		return errors.InvalidOperationError{Reason: "cannot increment a value that is not a counter"}
+	}
+	localOp := &Operation{
+		OpId:   NewOpIdWithValid(tree.lamportClock.increment()),
+		ObjId:  tree.ObjId,
+		Prop:   prop,
+		Action: INCREMENT,
+		Value:  delta,
+		Pred:   pred,
+		Succ:   make([]OpId, 0),
+		Insert: false,
+	}
+	for _, op := range counters {
+		op.addIncrement(localOp)
+	}
+	tree.insertOp(localOp, insertIdx)
+	return nil
+}
@@ -0,0 +1,90 @@
+package opset
+
+import (
+	"github.com/LiangrunDa/AutomergeWithMove/errors"
+)
+
+// Cursor points to an element of a list or a character of a text. Unlike an index it stays on its
+// element when other elements are inserted or deleted before it, and it follows the element when it
+// is moved to another list.
+type Cursor struct {
+	Obj  ExOpId // list or text the element was in when the cursor was created
+	Elem ExOpId // id of the operation that inserted the element
+}
+
+// GetCursor returns a cursor for the element at index of a list or text. Positions in texts are
+// counted in the text encoding.
+func (s *OpSet) GetCursor(objId OpId, index int) (Cursor, error) {
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return Cursor{}, err
+	}
+	if tree.Type == MAP {
+		return Cursor{}, errors.InvalidOperationError{Reason: "cannot get a cursor into a map"}
+	} else if tree.Type == TEXT {
+		if index, err = s.TextIndex(objId, index); err != nil {
+			return Cursor{}, err
+		}
+	}
+	element := tree.elementAt(index)
+	if element == nil {
+		return Cursor{}, errors.ListIndexExceedsLengthError{Index: index}
+	}
+	elemId := element.elementId()
+	return Cursor{Obj: *objId.ToExOpId(s), Elem: *elemId.ToExOpId(s)}, nil
+}
+
+// ResolveCursor returns the list or text the element of a cursor is in now, and its current index.
+// If the element was moved away, the cursor follows it to where the winning move put it.
+func (s *OpSet) ResolveCursor(cursor Cursor) (OpId, int, error) {
+	objId, ok1 := cursor.Obj.Lookup(s)
+	elemId, ok2 := cursor.Elem.Lookup(s)
+	if !ok1 || !ok2 {
+		return NullOpId, 0, errors.ObjectNotFoundError{ObjId: cursor.Obj.String()}
+	}
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return NullOpId, 0, err
+	}
+	loc := location{objId, elemId}
+	if operations, index := s.visibleAt(loc); len(operations) > 0 {
+		return objId, s.position(tree, index), nil
+	}
+
+	// the values that were at the element are identified by the id of the operation that created them
+	values := map[OpId]bool{}
+	for element := tree.operations.Front(); element != nil; element = element.Next() {
+		op := element.Value.(*Operation)
+		if op.location() != loc {
+			continue
+		}
+		if op.Action == MOVE {
+			values[*op.MovedID] = true
+		} else if op.Action == MAKE || op.Action == PUT {
+			values[op.OpId.Id] = true
+		}
+	}
+	for _, move := range s.moveManager.moveOps {
+		if !values[*move.MovedID] || !move.isVisible(s.moveManager) {
+			continue
+		}
+		if !move.Insert {
+			return NullOpId, 0, errors.InvalidOperationError{Reason: "the element was moved into a map"}
+		}
+		dst := s.opTrees[move.ObjId]
+		_, index := s.visibleAt(move.location())
+		return move.ObjId, s.position(dst, index), nil
+	}
+	return NullOpId, 0, errors.ElementDeletedError{ElemId: cursor.Elem.String()}
+}
+
+// position converts an element index into a position, which is counted in the text encoding for texts
+func (s *OpSet) position(tree *OpTree, index int) int {
+	if tree.Type != TEXT {
+		return index
+	}
+	if element := tree.elementAt(index); element != nil {
+		return tree.operations.UnitsBefore(element, s.textEncoding)
+	}
+	return tree.textLength()
+}
@@ -110,9 +110,6 @@ func (tree *DocumentTree) Visualize() string {
 	graphAst.SetName("DocumentTree")
 	graphAst.SetDir(true)
 	for opId, parentId := range tree.parentMap {
-		parentId.String()
-		opId.String()
-
 		parentIdStr := fmt.Sprintf("node%vc%v", parentId.ActorId, parentId.Counter)
 		opIdStr := fmt.Sprintf("node%vc%v", opId.ActorId, opId.Counter)
 		graphAst.AddNode(parentIdStr, opIdStr, map[string]string{
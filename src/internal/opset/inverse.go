@@ -0,0 +1,345 @@
+package opset
+
+import (
+	"github.com/LiangrunDa/AutomergeWithMove/errors"
+)
+
+// location is a property of a map or an element of a list
+type location struct {
+	objId OpId
+	key   any // string or element id
+}
+
+func (op *Operation) location() location {
+	if _, ok := op.Prop.(string); ok {
+		return location{op.ObjId, op.Prop}
+	}
+	return location{op.ObjId, op.elementId()}
+}
+
+// Invert applies operations that undo the effect of operations, which must be the operations of one
+// earlier change. Values are restored from the predecessors of the operations, deleted list elements
+// are inserted again, and moved objects are moved back to where they came from. A location whose
+// current value was written by an actor other than actor is left alone, so that undoing never
+// discards concurrent remote edits; the same holds for moves that lost against a concurrent move.
+// It returns the operations it applied, also when it fails halfway.
+func (s *OpSet) Invert(operations []*Operation, actor uint) ([]*Operation, error) {
+	inv := &inverter{s: s, actor: actor, inChange: map[OpId]bool{}, overwritten: map[OpId]bool{}}
+	for _, op := range operations {
+		inv.inChange[op.OpId.Id] = true
+		for _, pred := range op.Pred {
+			inv.overwritten[pred] = true
+		}
+	}
+
+	// the value every location had before the change is given by the predecessors from outside it
+	before := map[location][]OpId{}
+	inserted := map[location]bool{}
+	order := make([]location, 0)
+	addPreds := func(loc location, preds []OpId) {
+		if _, ok := before[loc]; !ok {
+			before[loc] = make([]OpId, 0)
+			order = append(order, loc)
+		}
+		for _, pred := range preds {
+			if !inv.inChange[pred] {
+				before[loc] = append(before[loc], pred)
+			}
+		}
+	}
+	for _, op := range operations {
+		switch op.Action {
+		case MARK, INCREMENT:
+			continue
+		case MOVE:
+			// the source of a move is restored by moving back, only the overwritten destination is restored
+			preds := make([]OpId, 0)
+			for _, pred := range op.Pred {
+				if predOp := s.findOperation(op.ObjId, pred); predOp != nil && predOp.location() == op.location() {
+					preds = append(preds, pred)
+				}
+			}
+			addPreds(op.location(), preds)
+		default:
+			addPreds(op.location(), op.Pred)
+		}
+		if op.Insert {
+			inserted[op.location()] = true
+		}
+	}
+
+	for i := len(operations) - 1; i >= 0; i-- {
+		if op := operations[i]; op.Action == MOVE {
+			if err := inv.moveBack(op); err != nil {
+				return inv.applied, err
+			}
+		}
+	}
+	for i := len(operations) - 1; i >= 0; i-- {
+		if op := operations[i]; op.Action == INCREMENT {
+			if err := inv.decrement(op); err != nil {
+				return inv.applied, err
+			}
+		}
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		loc := order[i]
+		if err := inv.restore(loc, before[loc], inserted[loc]); err != nil {
+			return inv.applied, err
+		}
+	}
+	return inv.applied, nil
+}
+
+type inverter struct {
+	s           *OpSet
+	actor       uint
+	inChange    map[OpId]bool
+	overwritten map[OpId]bool // the predecessors of the operations of the change
+	applied     []*Operation
+}
+
+func (inv *inverter) record() {
+	inv.applied = append(inv.applied, inv.s.lastOperation)
+}
+
+// findOperation returns the operation with the given id in an object, or nil
+func (s *OpSet) findOperation(objId OpId, id OpId) *Operation {
+	if op, ok := s.operations[id]; ok && op.ObjId == objId {
+		return op
+	}
+	return nil
+}
+
+// visibleAt returns the visible operations of a location, and the index of a list element, which is
+// the number of visible elements before it
+func (s *OpSet) visibleAt(loc location) ([]*Operation, int) {
+	tree := s.opTrees[loc.objId]
+	if property, ok := loc.key.(string); ok {
+		operations, _ := tree.search(property)
+		return operations, 0
+	}
+	head := s.findOperation(loc.objId, loc.key.(OpId))
+	if head == nil || head.leaf == nil {
+		return nil, tree.operations.Visible()
+	}
+	return head.groupOps, tree.operations.VisibleBefore(head)
+}
+
+func (s *OpSet) isPresent(objId OpId) bool {
+	if objId == RootOpId {
+		return true
+	}
+	_, err := s.moveManager.tree.getPresentParent(objId)
+	return err == nil
+}
+
+// key returns the property or the current index of a location
+func (s *OpSet) key(loc location) any {
+	if property, ok := loc.key.(string); ok {
+		return property
+	}
+	_, index := s.visibleAt(loc)
+	return index
+}
+
+func (inv *inverter) foreign(operations []*Operation) bool {
+	for _, op := range operations {
+		if op.OpId.Id.ActorId != inv.actor && !inv.inChange[op.OpId.Id] {
+			return true
+		}
+	}
+	return false
+}
+
+// moveBack moves what a move brought to its destination back to where it came from
+func (inv *inverter) moveBack(op *Operation) error {
+	s := inv.s
+	if !op.isVisible(s.moveManager) || !s.isPresent(op.ObjId) || !s.isPresent(*op.MoveSrc) {
+		// overwritten, deleted or lost against a concurrent move, or there is nowhere to go back to
+		return nil
+	}
+	var srcLoc *location
+	for _, pred := range op.Pred {
+		if predOp := s.findOperation(*op.MoveSrc, pred); predOp != nil && (*op.MoveSrc != op.ObjId || predOp.location() != op.location()) {
+			loc := predOp.location()
+			srcLoc = &loc
+			break
+		}
+	}
+	if srcLoc == nil {
+		return nil
+	}
+	if err := s.GenericMove(op.ObjId, *op.MoveSrc, s.key(op.location()), s.key(*srcLoc)); err != nil {
+		return err
+	}
+	inv.record()
+	return nil
+}
+
+func (inv *inverter) decrement(op *Operation) error {
+	s := inv.s
+	if !s.isPresent(op.ObjId) {
+		return nil
+	}
+	operations, _ := s.visibleAt(op.location())
+	for _, visible := range operations {
+		if op.overwrites(visible) {
+			if err := s.Increment(op.ObjId, s.key(op.location()), -op.Value.(int64)); err != nil {
+				return err
+			}
+			inv.record()
+			return nil
+		}
+	}
+	return nil
+}
+
+// restore gives a location the value of the greatest of preds again, or removes it if there are none
+func (inv *inverter) restore(loc location, preds []OpId, inserted bool) error {
+	s := inv.s
+	if inv.inChange[loc.objId] || !s.isPresent(loc.objId) {
+		// the object is removed or restored as a whole
+		return nil
+	}
+	current, index := s.visibleAt(loc)
+	if inv.foreign(current) {
+		return nil
+	}
+	var previous *Operation
+	for _, pred := range preds {
+		if predOp := s.findOperation(loc.objId, pred); predOp != nil && (previous == nil || pred.GreaterThan(s, &previous.OpId.Id)) {
+			previous = predOp
+		}
+	}
+	if previous == nil || inserted {
+		if len(current) > 0 {
+			if err := s.Delete(loc.objId, s.key(loc)); err != nil {
+				return err
+			}
+			inv.record()
+		}
+		return nil
+	}
+	if len(current) == 1 && current[0] == previous {
+		return nil
+	}
+
+	value, isObject := inv.valueBefore(previous)
+	property, isMap := loc.key.(string)
+	if isMap {
+		if isObject {
+			return inv.copyObject(value.(OpId), func(objType ObjType) (OpId, error) {
+				return s.PutObject(loc.objId, property, objType)
+			})
+		}
+		if err := s.Put(loc.objId, property, value); err != nil {
+			return err
+		}
+		inv.record()
+		return nil
+	}
+	if len(current) > 0 {
+		if !isObject {
+			if err := s.Put(loc.objId, index, value); err != nil {
+				return err
+			}
+			inv.record()
+			return nil
+		}
+		// objects can't be put into a list element, so the element is replaced
+		if err := s.Delete(loc.objId, index); err != nil {
+			return err
+		}
+		inv.record()
+	}
+	if isObject {
+		return inv.copyObject(value.(OpId), func(objType ObjType) (OpId, error) {
+			return s.InsertObject(loc.objId, index, objType)
+		})
+	}
+	if err := s.Insert(loc.objId, index, value); err != nil {
+		return err
+	}
+	inv.record()
+	return nil
+}
+
+// copyObject creates a new object with create and copies the content objId had before the change
+// into it. A deleted object can't come back, so restoring it restores a copy.
+func (inv *inverter) copyObject(objId OpId, create func(objType ObjType) (OpId, error)) error {
+	s := inv.s
+	tree, ok := s.opTrees[objId]
+	if !ok {
+		return errors.ObjectNotFoundError{ObjId: objId.String()}
+	}
+	copied, err := create(tree.Type)
+	if err != nil {
+		return err
+	}
+	inv.record()
+	for index, op := range inv.entriesBefore(tree) {
+		value, isObject := inv.valueBefore(op)
+		if tree.Type == MAP {
+			key := op.Prop.(string)
+			if isObject {
+				err = inv.copyObject(value.(OpId), func(objType ObjType) (OpId, error) {
+					return s.PutObject(copied, key, objType)
+				})
+			} else if err = s.Put(copied, key, value); err == nil {
+				inv.record()
+			}
+		} else {
+			if isObject {
+				err = inv.copyObject(value.(OpId), func(objType ObjType) (OpId, error) {
+					return s.InsertObject(copied, index, objType)
+				})
+			} else if err = s.Insert(copied, index, value); err == nil {
+				inv.record()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entriesBefore returns the winning operation of every property or element of a tree as it was
+// before the change
+func (inv *inverter) entriesBefore(tree *OpTree) []*Operation {
+	entries := make([]*Operation, 0)
+	var key any
+	var winner *Operation
+	for element := tree.operations.Front(); element != nil; element = element.Next() {
+		op := element.Value.(*Operation)
+		if (tree.Type == MAP && op.Prop != key) || (tree.Type != MAP && op.Insert) {
+			if winner != nil {
+				entries = append(entries, winner)
+			}
+			key = op.Prop
+			winner = nil
+		}
+		if inv.visibleBefore(op) {
+			winner = op
+		}
+	}
+	if winner != nil {
+		entries = append(entries, winner)
+	}
+	return entries
+}
+
+// visibleBefore reports whether an operation was visible before the change. The change overwrote
+// exactly its predecessors, every other operation is as visible as it is now.
+func (inv *inverter) visibleBefore(op *Operation) bool {
+	if op.Action == DELETE || op.Action == INCREMENT || inv.inChange[op.OpId.Id] {
+		return false
+	}
+	return inv.overwritten[op.OpId.Id] || op.visible
+}
+
+// valueBefore is the value of an operation without the increments of the change
+func (inv *inverter) valueBefore(op *Operation) (any, bool) {
+	return op.valueWithout(inv.inChange)
+}
@@ -1,7 +1,6 @@
 package opset
 
 import (
-	"container/list"
 	errors "github.com/LiangrunDa/AutomergeWithMove/errors"
 )
 
@@ -12,70 +11,57 @@ type ReplicatedList interface {
 	ListPut(index int, value any) error
 }
 
+// element returns the operations of the list element at a visible index, starting with its insert
+// operation, and the position after them
+func (opt *OpTree) element(index int) ([]*Operation, int) {
+	head := opt.operations.NthVisible(index)
+	if head == nil {
+		return nil, opt.operations.Len()
+	}
+	pos := opt.operations.Position(head.Value.(*Operation))
+	var group []*Operation
+	for operation := head; operation != nil; operation = operation.Next() {
+		op := operation.Value.(*Operation)
+		if op.Insert && len(group) > 0 {
+			break
+		}
+		group = append(group, op)
+		pos++
+	}
+	return group, pos
+}
+
 func (opt *OpTree) moveNth(index int) ([]*Operation, OpId, any) {
-	var lastSeen *Operation
-	seen := 0
 	var res []*Operation
 	var targetObjId OpId
 	var scalarValue any
 
-	for operation := opt.operations.Front(); operation != nil; operation = operation.Next() {
-		if op, ok := operation.Value.(*Operation); ok {
-			if op.Insert {
-				if seen > index {
-					return res, targetObjId, scalarValue
-				}
-				lastSeen = nil
-			}
-			if op.isVisible(opt.ops.moveManager) && lastSeen == nil {
-				seen += 1
-				lastSeen = op
-			}
-			if op.isVisible(opt.ops.moveManager) && seen > index {
-				res = append(res, op)
-				if op.Action == MAKE {
-					targetObjId = op.OpId.Id
-				} else if op.Action == PUT {
-					targetObjId = op.OpId.Id
-					scalarValue = op.Value
-				} else if op.Action == MOVE {
-					targetObjId = *op.MovedID
-					if op.Value != nil {
-						scalarValue = op.Value
-					}
+	group, _ := opt.element(index)
+	for _, op := range group {
+		if op.isVisible(opt.ops.moveManager) {
+			res = append(res, op)
+			if op.Action == MAKE {
+				targetObjId = op.OpId.Id
+			} else if op.Action == PUT {
+				targetObjId = op.OpId.Id
+				scalarValue = op.withIncrements(op.Value)
+			} else if op.Action == MOVE {
+				targetObjId = *op.MovedID
+				if op.Value != nil {
+					scalarValue = op.withIncrements(op.Value)
 				}
 			}
-		} else {
-			panic("element is not an operation")
 		}
 	}
 	return res, targetObjId, scalarValue
 }
 
 func (opt *OpTree) nth(index int) ([]*Operation, int) {
-	var lastSeen *Operation
-	seen := 0
-	pos := 0
 	var res []*Operation
-
-	for operation := opt.operations.Front(); operation != nil; operation = operation.Next() {
-		if op, ok := operation.Value.(*Operation); ok {
-			if op.Insert {
-				if seen > index {
-					return res, pos
-				}
-				lastSeen = nil
-			}
-			if op.isVisible(opt.ops.moveManager) && lastSeen == nil {
-				seen += 1
-				lastSeen = op
-			}
-			if op.isVisible(opt.ops.moveManager) && seen > index {
-				res = append(res, op)
-			}
-			pos++
-		} else {
-			panic("element is not an operation")
+	group, pos := opt.element(index)
+	for _, op := range group {
+		if op.isVisible(opt.ops.moveManager) {
+			res = append(res, op)
 		}
 	}
 	return res, pos
@@ -91,94 +77,59 @@ func (opt *OpTree) ListGet(index int) (any, error) {
 		return last.OpId, nil
 	} else if last.Action == MOVE {
 		if last.Value != nil {
-			return last.Value, nil
+			return last.withIncrements(last.Value), nil
 		} else {
 			return *last.MovedID, nil
 		}
 	} else if last.Action == PUT {
-		return last.Value, nil
+		return last.withIncrements(last.Value), nil
 	} else {
 		return nil, errors.UnknownError{}
 	}
 }
 
 func (opt *OpTree) insertNth(index int) (int, OpId, error) {
-	insertRowNumber := -1
-	var insertProp OpId
-	var lastSeen *Operation
-	seen := 0 // number of elements we've ever seen
-	pos := 0  // row number we're currently at
-	found := false
-	var lastOperation *list.Element
-
-	for operation := opt.operations.Front(); operation != nil; operation = operation.Next() {
-		lastOperation = operation
-		if operation, ok := operation.Value.(*Operation); ok {
-			// if we find the insert operation at `index`, we will insert the new operation before it
-			if operation.Insert {
-				if insertRowNumber == -1 && seen >= index {
-					insertRowNumber = pos
-					found = true
-				}
-			}
-
-			// if we find an insert operation, then we potentially find an element
-			// 1. if it is invisible, and no following put operation is visible, then we don't find an element
-			// 2. if it is visible, then we find an element
-			// 3. if it is invisible, but a following put operation is visible, then we find an element
-			if operation.Insert {
-				lastSeen = nil
-			}
-
-			// if we find an operation (could be an insert op, or a following put op) that is visible, then we find an element
-			if operation.isVisible(opt.ops.moveManager) && lastSeen == nil {
-				// if we already find the insert location, simply return the result
-				if found {
-					return insertRowNumber, insertProp, nil
-				}
-				// update number of elements we've ever seen
-				seen += 1
-				// update the last seen operation
-				lastSeen = operation
-				if operation.Insert {
-					insertProp = operation.OpId.Id
-				} else {
-					if opId, ok := operation.Prop.(OpId); ok {
-						insertProp = opId
-					} else {
-						panic("operation Value is not an OpId")
-					}
-				}
-			}
-			pos++
-		} else {
-			panic("element is not an operation")
-		}
+	if index < 0 || index > opt.operations.Visible() {
+		return 0, OpId{}, errors.ListIndexExceedsLengthError{Index: index}
 	}
-
-	// if we don't find an operation at `index`, we need to insert it at the end of the optree
-	if lastOperation == nil {
-		// the list is empty, the property is <0, 0> which is the virtual head
-		return pos, OpId{}, nil
-	} else {
-		// the list is not empty
-		return pos, insertProp, nil
+	if index == 0 {
+		// the property is <0, 0> which is the virtual head
+		return 0, OpId{}, nil
 	}
+	// insert after the operations of the element before index
+	group, pos := opt.element(index - 1)
+	return pos, group[0].OpId.Id, nil
 }
 
-func (opt *OpTree) ListInsert(index int, value any) {
-	insertRowNumber, insertProp, _ := opt.insertNth(index)
-	localOp := Operation{
-		OpId:   NewOpIdWithValid(opt.lamportClock.increment()),
-		ObjId:  opt.ObjId,
-		Prop:   insertProp,
-		Action: PUT,
-		Value:  value,
-		Pred:   []OpId{},
-		Succ:   []OpId{},
-		Insert: true,
+func (opt *OpTree) ListInsert(index int, value any) error {
+	_, err := opt.listInsertAll(index, []any{value})
+	return err
+}
+
+// listInsertAll inserts values at index and returns their operations. The insertion point is looked
+// up once, since every value is inserted right after the one before it.
+func (opt *OpTree) listInsertAll(index int, values []any) ([]*Operation, error) {
+	insertRowNumber, insertProp, err := opt.insertNth(index)
+	if err != nil {
+		return nil, err
+	}
+	operations := make([]*Operation, 0, len(values))
+	for _, value := range values {
+		localOp := &Operation{
+			OpId:   NewOpIdWithValid(opt.lamportClock.increment()),
+			ObjId:  opt.ObjId,
+			Prop:   insertProp,
+			Action: PUT,
+			Value:  value,
+			Pred:   []OpId{},
+			Succ:   []OpId{},
+			Insert: true,
+		}
+		opt.insertOp(localOp, insertRowNumber)
+		operations = append(operations, localOp)
+		insertRowNumber, insertProp = insertRowNumber+1, localOp.OpId.Id
 	}
-	opt.insertOp(&localOp, insertRowNumber)
+	return operations, nil
 }
 
 func (opt *OpTree) ListPut(index int, value any) error {
@@ -262,6 +213,45 @@ func (opt *OpTree) ListDelete(index int) error {
 	return nil
 }
 
+// listElements returns the visible operations of every visible list element
+func (opt *OpTree) listElements() [][]*Operation {
+	elements := make([][]*Operation, 0, opt.operations.Visible())
+	for index := 0; index < opt.operations.Visible(); index++ {
+		elements = append(elements, opt.elementAt(index).groupOps)
+	}
+	return elements
+}
+
+// elementAt returns the insert operation of the list element at a visible index, or nil
+func (opt *OpTree) elementAt(index int) *Operation {
+	if head := opt.operations.NthVisible(index); head != nil {
+		return head.Value.(*Operation)
+	}
+	return nil
+}
+
+// indexOfObject returns the index of the list element holding an object, which was put there by the
+// operation that created it or by the move that won
+func (opt *OpTree) indexOfObject(objId OpId) (int, bool) {
+	holders := make([]*Operation, 0, 2)
+	if winners, ok := opt.ops.moveManager.winners[objId]; ok {
+		if winner := winners.Peek(); winner != nil {
+			holders = append(holders, opt.ops.moveManager.moveOps[winner.(*OpIdWithValid).Id])
+		}
+	}
+	holders = append(holders, opt.ops.operations[objId])
+	for _, op := range holders {
+		if op != nil && op.ObjId == opt.ObjId && op.visible {
+			return opt.operations.VisibleBefore(opt.operations.head(op)), true
+		}
+	}
+	return 0, false
+}
+
+func (opt *OpTree) ListLength() int {
+	return opt.operations.Visible()
+}
+
 func (opt *OpTree) ListSeekOperation(seekOp *Operation) (int, bool, []*Operation) {
 	pos := 0
 	foundTarget := false
@@ -269,10 +259,17 @@ func (opt *OpTree) ListSeekOperation(seekOp *Operation) (int, bool, []*Operation
 	pred := []*Operation{}
 	seekOpId := seekOp.Prop.(OpId)
 
+	start := opt.operations.Front()
 	if seekOpId == RootOpId {
 		foundTarget = true
+	} else if target, ok := opt.ops.operations[seekOpId]; ok && target.ObjId == opt.ObjId && target.leaf != nil {
+		// skip the operations before the target
+		pos = opt.operations.Position(target)
+		start = opt.operations.elementOf(target)
+	} else {
+		return opt.operations.Len(), false, pred
 	}
-	for operation := opt.operations.Front(); operation != nil; operation = operation.Next() {
+	for operation := start; operation != nil; operation = operation.Next() {
 		if op, ok := operation.Value.(*Operation); ok {
 			if !foundTarget { // find target parent of the RGA tree
 				if op.Insert && op.OpId.Id == seekOpId {
@@ -1,7 +1,6 @@
 package opset
 
 import (
-	"container/list"
 	"github.com/LiangrunDa/AutomergeWithMove/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -14,20 +13,10 @@ type ReplicatedMap interface {
 
 // Return the first operation matching the prop.
 // If no operations is matched, return the position where the operation should be inserted
-func (opt *OpTree) findStart(prop string) (int, *list.Element) {
-	pos := 0
-	for element := opt.operations.Front(); element != nil; element = element.Next() {
-		if operation, ok := element.Value.(*Operation); ok {
-			strProp := operation.Prop.(string)
-			if strProp >= prop {
-				return pos, element
-			}
-		} else {
-			panic("element is not an operation")
-		}
-		pos++
-	}
-	return pos, nil
+func (opt *OpTree) findStart(prop string) (int, *seqElement) {
+	return opt.operations.Search(func(op *Operation) bool {
+		return op.Prop.(string) >= prop
+	})
 }
 
 func (opt *OpTree) moveSearch(prop string) (OpId, []*Operation, any) {
@@ -49,12 +38,12 @@ func (opt *OpTree) moveSearch(prop string) (OpId, []*Operation, any) {
 			if operation.Action == MAKE {
 				targetObjId = operation.OpId.Id
 			} else if operation.Action == PUT {
-				scalarValue = operation.Value
+				scalarValue = operation.withIncrements(operation.Value)
 				targetObjId = operation.OpId.Id
 			} else if operation.Action == MOVE {
 				targetObjId = *operation.MovedID
 				if operation.Value != nil {
-					scalarValue = operation.Value
+					scalarValue = operation.withIncrements(operation.Value)
 				}
 			}
 			pos++
@@ -134,13 +123,13 @@ func (opt *OpTree) MapGet(prop string) (any, error) {
 	} else if last.Action == MOVE {
 		if last.Value != nil {
 			// Move a scalar value
-			return last.Value, nil
+			return last.withIncrements(last.Value), nil
 		} else {
 			// move an object
 			return *last.MovedID, nil
 		}
 	} else {
-		return last.Value, nil
+		return last.withIncrements(last.Value), nil
 	}
 }
 
@@ -171,6 +160,30 @@ func (opt *OpTree) MapDelete(prop string) error {
 	return nil
 }
 
+// MapKeys returns the properties with at least one visible operation, in sorted order
+func (opt *OpTree) MapKeys() []string {
+	return opt.mapKeysFrom("", func(string) bool { return true })
+}
+
+// mapKeysFrom returns the visible properties from the first one not less than from, in sorted
+// order, as long as they satisfy while
+func (opt *OpTree) mapKeysFrom(from string, while func(prop string) bool) []string {
+	keys := make([]string, 0)
+	_, start := opt.findStart(from)
+	for element := start; element != nil; element = element.Next() {
+		operation := element.Value.(*Operation)
+		prop := operation.Prop.(string)
+		if !while(prop) {
+			break
+		}
+		// the first operation of a property records whether the property is visible
+		if operation.groupVisible() {
+			keys = append(keys, prop)
+		}
+	}
+	return keys
+}
+
 func (opt *OpTree) MapSeekOperation(seekOp *Operation) (int, bool, []*Operation) {
 	pos, start := opt.findStart(seekOp.Prop.(string))
 	pred := []*Operation{}
@@ -204,6 +217,7 @@ func (opt *OpTree) UpdateSourcePredecessors(moveOp *Operation) {
 		if operation, ok := element.Value.(*Operation); ok {
 			if moveOp.overwrites(operation) {
 				operation.Succ = append(operation.Succ, moveOp.OpId.Id)
+				operation.refreshVisibility()
 			}
 		} else {
 			panic("element is not an operation")
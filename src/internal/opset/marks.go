@@ -0,0 +1,245 @@
+package opset
+
+import (
+	"fmt"
+	"github.com/LiangrunDa/AutomergeWithMove/errors"
+	"reflect"
+	"sort"
+)
+
+// A mark formats a range of a text. Its boundaries are anchored to the gaps next to elements of
+// the text rather than to positions, so that the range follows concurrent edits. Where concurrent
+// marks with the same name overlap, the mark with the greatest OpId wins; a mark with a nil value
+// removes the formatting.
+
+// ExpandPolicy tells whether text inserted at the boundaries of a mark gets the mark as well
+type ExpandPolicy uint8
+
+const (
+	ExpandNone ExpandPolicy = iota
+	ExpandBefore
+	ExpandAfter
+	ExpandBoth
+)
+
+// MarkAnchor is the gap before or after an element of a text. The zero OpId stands for the start
+// of the text if After is set, and for its end otherwise.
+type MarkAnchor struct {
+	Elem  OpId `json:"Elem"`
+	After bool `json:"After"`
+}
+
+type MarkRange struct {
+	Start MarkAnchor `json:"Start"`
+	End   MarkAnchor `json:"End"`
+}
+
+type ExMarkAnchor struct {
+	Elem  ExOpId `json:"Elem"`
+	After bool   `json:"After"`
+}
+
+type ExMarkRange struct {
+	Start ExMarkAnchor `json:"Start"`
+	End   ExMarkAnchor `json:"End"`
+}
+
+// MarkSpan is a resolved range of a text with the same value for a mark. Start and End are counted
+// in the text encoding of the OpSet.
+type MarkSpan struct {
+	Name  string
+	Value any
+	Start int
+	End   int
+}
+
+func (r *MarkRange) toExMarkRange(s *OpSet) *ExMarkRange {
+	return &ExMarkRange{
+		Start: ExMarkAnchor{Elem: *r.Start.Elem.ToExOpId(s), After: r.Start.After},
+		End:   ExMarkAnchor{Elem: *r.End.Elem.ToExOpId(s), After: r.End.After},
+	}
+}
+
+func (r *ExMarkRange) toMarkRange(s *OpSet) *MarkRange {
+	return &MarkRange{
+		Start: MarkAnchor{Elem: *r.Start.Elem.ToOpId(s), After: r.Start.After},
+		End:   MarkAnchor{Elem: *r.End.Elem.ToOpId(s), After: r.End.After},
+	}
+}
+
+// elementId returns the id of the list element a visible operation belongs to
+func (op *Operation) elementId() OpId {
+	if op.Insert {
+		return op.OpId.Id
+	}
+	return op.Prop.(OpId)
+}
+
+// Mark formats the characters from start to end of a text object. A nil value removes the mark.
+func (s *OpSet) Mark(objId OpId, start int, end int, name string, value any, expand ExpandPolicy) error {
+	tree, err := s.getText(objId)
+	if err != nil {
+		return err
+	}
+	if start >= end {
+		return errors.InvalidOperationError{Reason: fmt.Sprintf("cannot mark the empty range %d to %d", start, end)}
+	}
+	startIdx, err := s.TextIndex(objId, start)
+	if err != nil {
+		return err
+	}
+	endIdx, err := s.TextIndex(objId, end)
+	if err != nil {
+		return err
+	}
+	markRange := &MarkRange{}
+	if expand == ExpandBefore || expand == ExpandBoth {
+		if startIdx == 0 {
+			markRange.Start = MarkAnchor{Elem: RootOpId, After: true}
+		} else {
+			markRange.Start = MarkAnchor{Elem: tree.elementAt(startIdx - 1).elementId(), After: true}
+		}
+	} else {
+		markRange.Start = MarkAnchor{Elem: tree.elementAt(startIdx).elementId(), After: false}
+	}
+	if expand == ExpandAfter || expand == ExpandBoth {
+		if endIdx == tree.operations.Visible() {
+			markRange.End = MarkAnchor{Elem: RootOpId, After: false}
+		} else {
+			markRange.End = MarkAnchor{Elem: tree.elementAt(endIdx).elementId(), After: false}
+		}
+	} else {
+		markRange.End = MarkAnchor{Elem: tree.elementAt(endIdx - 1).elementId(), After: true}
+	}
+
+	localOp := &Operation{
+		OpId:   NewOpIdWithValid(s.lamportClock.increment()),
+		ObjId:  objId,
+		Prop:   name,
+		Action: MARK,
+		Value:  value,
+		Pred:   make([]OpId, 0),
+		Succ:   make([]OpId, 0),
+		Mark:   markRange,
+	}
+	tree.insertMark(localOp)
+	s.lastOperation = localOp
+	return nil
+}
+
+func (opt *OpTree) insertMark(op *Operation) {
+	for _, mark := range opt.marks {
+		if mark.OpId.Id == op.OpId.Id {
+			return
+		}
+	}
+	opt.marks = append(opt.marks, op)
+}
+
+func (opt *OpTree) removeMark(op *Operation) {
+	for i, mark := range opt.marks {
+		if mark == op {
+			opt.marks = append(opt.marks[:i], opt.marks[i+1:]...)
+			return
+		}
+	}
+}
+
+// Marks returns the formatting of a text object, ordered by start and name
+func (s *OpSet) Marks(objId OpId) ([]MarkSpan, error) {
+	tree, err := s.getText(objId)
+	if err != nil {
+		return nil, err
+	}
+
+	// every element, including deleted ones, gets a coordinate; the gaps before and after it are
+	// the coordinates right next to it
+	coordinates := map[OpId]int{}
+	chars := make([]int, 0)    // coordinates of the visible elements
+	values := make([]any, 0)   // values of the visible elements
+	visible := make([]bool, 0) // whether the element at a sequence number is visible
+	for operation := tree.operations.Front(); operation != nil; operation = operation.Next() {
+		op := operation.Value.(*Operation)
+		if op.Insert {
+			coordinates[op.OpId.Id] = 4*len(visible) + 2
+			visible = append(visible, false)
+		}
+		if len(visible) > 0 && op.isVisible(s.moveManager) {
+			value, _ := op.visibleValue()
+			if visible[len(visible)-1] {
+				values[len(values)-1] = value
+			} else {
+				visible[len(visible)-1] = true
+				chars = append(chars, 4*(len(visible)-1)+2)
+				values = append(values, value)
+			}
+		}
+	}
+	textEnd := 4*len(visible) + 4
+	anchorCoordinate := func(anchor MarkAnchor) (int, bool) {
+		if anchor.Elem == RootOpId {
+			if anchor.After {
+				return 0, true
+			}
+			return textEnd, true
+		}
+		coordinate, ok := coordinates[anchor.Elem]
+		if anchor.After {
+			return coordinate + 1, ok
+		}
+		return coordinate - 1, ok
+	}
+
+	// the winning mark of every name at every visible element
+	names := make([]string, 0)
+	winners := map[string][]*Operation{}
+	for _, mark := range tree.marks {
+		start, ok1 := anchorCoordinate(mark.Mark.Start)
+		end, ok2 := anchorCoordinate(mark.Mark.End)
+		if !ok1 || !ok2 {
+			continue
+		}
+		name := mark.Prop.(string)
+		if _, ok := winners[name]; !ok {
+			names = append(names, name)
+			winners[name] = make([]*Operation, len(chars))
+		}
+		for i, char := range chars {
+			if start < char && char < end {
+				if winner := winners[name][i]; winner == nil || mark.OpId.Id.GreaterThan(s, &winner.OpId.Id) {
+					winners[name][i] = mark
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+
+	spans := make([]MarkSpan, 0)
+	for _, name := range names {
+		var open *MarkSpan
+		pos := 0
+		for i, winner := range winners[name] {
+			var value any
+			if winner != nil {
+				value = winner.Value
+			}
+			if open != nil && (value == nil || !reflect.DeepEqual(open.Value, value)) {
+				open.End = pos
+				spans = append(spans, *open)
+				open = nil
+			}
+			if open == nil && value != nil {
+				open = &MarkSpan{Name: name, Value: value, Start: pos}
+			}
+			pos += s.textEncoding.width(values[i])
+		}
+		if open != nil {
+			open.End = pos
+			spans = append(spans, *open)
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].Start < spans[j].Start
+	})
+	return spans, nil
+}
@@ -0,0 +1,46 @@
+package opset
+
+// Materialize returns the visible state of an object as nested map[string]any and []any values.
+// Text objects become strings.
+func (s *OpSet) Materialize(objId OpId) (any, error) {
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return nil, err
+	}
+	return s.materializeTree(tree)
+}
+
+func (s *OpSet) materializeTree(tree *OpTree) (any, error) {
+	if tree.Type == MAP {
+		result := make(map[string]any)
+		for _, key := range tree.MapKeys() {
+			operations, _ := tree.search(key)
+			value, err := s.materializeValue(operations[len(operations)-1])
+			if err != nil {
+				return nil, err
+			}
+			result[key] = value
+		}
+		return result, nil
+	} else if tree.Type == TEXT {
+		return tree.text(), nil
+	} else {
+		result := make([]any, 0)
+		for _, operations := range tree.listElements() {
+			value, err := s.materializeValue(operations[len(operations)-1])
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, value)
+		}
+		return result, nil
+	}
+}
+
+func (s *OpSet) materializeValue(op *Operation) (any, error) {
+	value, isObject := op.visibleValue()
+	if isObject {
+		return s.Materialize(value.(OpId))
+	}
+	return value, nil
+}
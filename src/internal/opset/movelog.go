@@ -0,0 +1,235 @@
+package opset
+
+// MoveCheckpointInterval is the number of log entries between two checkpoints of the move log
+var MoveCheckpointInterval = 256
+
+// moveCheckpoint records where every moved object was and which move won for it after a number of
+// log entries were applied, so that undoing many moves restores it instead of reverting them one
+// by one
+type moveCheckpoint struct {
+	position  int // number of log entries applied before, including truncated ones
+	locations map[OpId]treeLocation
+	winners   map[OpId]*OpIdWithValid // nil if no move won
+}
+
+// MoveLogStats counts how much work the move log did
+type MoveLogStats struct {
+	LogLength    int // entries that can still be undone
+	Truncated    int // entries dropped below the stable frontier
+	Checkpoints  int // checkpoints kept
+	LastReverts  int // entries undone by the latest apply
+	TotalReverts int
+	MaxReverts   int // the most entries undone by one apply
+	Restores     int // applies that restored a checkpoint
+	Replays      int // applies that went back to the stable frontier, since they were older than it
+	Tracked      int // moves whose validity is still tracked, the others are below the frontier
+}
+
+// push adds an applied move to the log and takes a checkpoint every MoveCheckpointInterval entries
+func (m *MoveManager) push(entry LogEntry) {
+	m.opLog = append(m.opLog, entry)
+	if position := m.truncated + len(m.opLog); MoveCheckpointInterval > 0 && position%MoveCheckpointInterval == 0 {
+		m.checkpoints = append(m.checkpoints, m.checkpoint(position))
+	}
+}
+
+// pop removes the latest entry from the log, without reverting it
+func (m *MoveManager) pop() LogEntry {
+	entry := m.opLog[len(m.opLog)-1]
+	m.opLog = m.opLog[:len(m.opLog)-1]
+	m.dropCheckpoints()
+	return entry
+}
+
+// dropCheckpoints removes the checkpoints of entries that are not in the log anymore
+func (m *MoveManager) dropCheckpoints() {
+	position := m.truncated + len(m.opLog)
+	for len(m.checkpoints) > 0 && m.checkpoints[len(m.checkpoints)-1].position > position {
+		m.checkpoints = m.checkpoints[:len(m.checkpoints)-1]
+	}
+}
+
+func newMoveCheckpoint(position int) moveCheckpoint {
+	return moveCheckpoint{
+		position:  position,
+		locations: make(map[OpId]treeLocation),
+		winners:   make(map[OpId]*OpIdWithValid),
+	}
+}
+
+func (m *MoveManager) checkpoint(position int) moveCheckpoint {
+	checkpoint := newMoveCheckpoint(position)
+	for mid, winners := range m.winners {
+		checkpoint.locations[mid] = treeLocation{parent: m.tree.getParent(mid), property: m.tree.getProperty(mid)}
+		if winner := winners.Peek(); winner != nil {
+			checkpoint.winners[mid] = winner.(*OpIdWithValid)
+		}
+	}
+	return checkpoint
+}
+
+// undo takes back the log entries that are greater than id and returns them, oldest first
+func (m *MoveManager) undo(id OpId) []LogEntry {
+	count := 0
+	for count < len(m.opLog) && m.opLog[len(m.opLog)-1-count].op.OpId.Id.GreaterThan(m.ops, &id) {
+		count++
+	}
+	if count == len(m.opLog) && m.truncated > 0 && m.truncatedTo.GreaterThan(m.ops, &id) {
+		// the entries to undo are gone, which only happens for actors unknown at truncation
+		undone := m.replay()
+		m.count(len(undone))
+		m.stats.Replays++
+		return undone
+	}
+	if count > MoveCheckpointInterval {
+		// restore the latest checkpoint before the entries to undo and redo the ones after it
+		for i := len(m.checkpoints) - 1; i >= 0; i-- {
+			checkpoint := m.checkpoints[i]
+			if checkpoint.position <= m.truncated+len(m.opLog)-count && checkpoint.position >= m.truncated {
+				undone := append([]LogEntry{}, m.opLog[checkpoint.position-m.truncated:]...)
+				m.opLog = m.opLog[:checkpoint.position-m.truncated]
+				m.dropCheckpoints()
+				m.restore(checkpoint, undone)
+				m.count(len(undone))
+				m.stats.Restores++
+				return undone
+			}
+		}
+	}
+	undone := make([]LogEntry, count)
+	for i := count - 1; i >= 0; i-- {
+		undone[i] = m.pop()
+		m.revert(undone[i])
+	}
+	m.count(count)
+	return undone
+}
+
+func (m *MoveManager) count(reverts int) {
+	m.stats.LastReverts = reverts
+	m.stats.TotalReverts += reverts
+	if reverts > m.stats.MaxReverts {
+		m.stats.MaxReverts = reverts
+	}
+}
+
+// restore brings the objects moved by undone entries back to where they were at a checkpoint, like
+// reverting the entries one by one would
+func (m *MoveManager) restore(checkpoint moveCheckpoint, undone []LogEntry) {
+	moved := make(map[OpId]bool)
+	for _, entry := range undone {
+		if entry.from != nil {
+			moved[*entry.op.MovedID] = true
+		}
+	}
+	for mid := range moved {
+		winner := checkpoint.winners[mid]
+		winners := m.winners[mid]
+		for winners.Len() > 0 && winners.Peek().(*OpIdWithValid) != winner {
+			winners.Pop()
+		}
+		if winner != nil {
+			m.setValid(winner, true, "It is the winner again")
+		}
+		location, ok := checkpoint.locations[mid]
+		if !ok {
+			location = m.created(mid)
+		}
+		m.tree.updateParentAs(mid, location.parent)
+		m.tree.updateProperty(mid, location.property)
+	}
+}
+
+// created returns where an object was created, before any move
+func (m *MoveManager) created(mid OpId) treeLocation {
+	op := m.ops.operations[mid]
+	return treeLocation{parent: op.ObjId, property: op.Prop}
+}
+
+// replay brings the moved objects back to where they were at the stable frontier and returns the
+// whole log to be applied again, oldest first. The moves below the frontier are gone, so moves that
+// are older than it are applied on top of it and lose against stable moves of the same objects.
+func (m *MoveManager) replay() []LogEntry {
+	undone := m.opLog
+	m.opLog = make([]LogEntry, 0)
+	m.dropCheckpoints()
+	m.restore(m.frontier, undone)
+	return undone
+}
+
+// Truncate drops the log entries of causally stable moves, whose counter is at most the one stable
+// holds for their actor. Every known actor has seen them, so their later operations are greater
+// and never undo them. The frontier snapshot takes over where the dropped moves put the objects,
+// and the moves that don't win anymore aren't tracked any longer.
+func (m *MoveManager) Truncate(stable map[uint]uint64) {
+	isStable := func(id OpId) bool {
+		latest, ok := stable[id.ActorId]
+		return ok && id.Counter <= latest
+	}
+	count := 0
+	for count < len(m.opLog) && isStable(m.opLog[count].op.OpId.Id) {
+		count++
+	}
+	if count == 0 {
+		return
+	}
+	dropped := m.opLog[:count]
+	moved := make(map[OpId]bool)
+	for _, entry := range dropped {
+		if entry.from == nil {
+			m.untrack(entry.op.OpId.Id)
+		} else {
+			mid := *entry.op.MovedID
+			moved[mid] = true
+			m.frontier.locations[mid] = treeLocation{parent: entry.op.ObjId, property: entry.op.Prop}
+			m.frontier.winners[mid] = entry.op.OpId
+		}
+		if id := entry.op.OpId.Id; id.GreaterThan(m.ops, &m.truncatedTo) {
+			m.truncatedTo = id
+		}
+	}
+	m.truncated += count
+	m.frontier.position = m.truncated
+	m.opLog = append(make([]LogEntry, 0, len(m.opLog)-count), m.opLog[count:]...)
+	for len(m.checkpoints) > 0 && m.checkpoints[0].position < m.truncated {
+		m.checkpoints = m.checkpoints[1:]
+	}
+
+	// keep the winner at the frontier, it wins again when the later ones are undone
+	for mid := range moved {
+		winners := make([]*OpIdWithValid, 0)
+		for m.winners[mid].Len() > 0 {
+			winners = append(winners, m.winners[mid].Pop().(*OpIdWithValid))
+		}
+		kept := 0
+		for kept < len(winners) && winners[kept] != m.frontier.winners[mid] {
+			kept++
+		}
+		if kept < len(winners) {
+			kept++
+		}
+		for i := kept - 1; i >= 0; i-- {
+			m.winners[mid].Push(winners[i])
+		}
+		for _, winner := range winners[kept:] {
+			m.untrack(winner.Id)
+		}
+	}
+}
+
+// untrack forgets a move below the frontier that can't win anymore. Its operation keeps whether it
+// is valid and whether it won, which is all that visibility needs.
+func (m *MoveManager) untrack(id OpId) {
+	delete(m.valid, id)
+	delete(m.moveIDMap, id)
+	delete(m.moveOps, id)
+}
+
+func (m *MoveManager) Stats() MoveLogStats {
+	stats := m.stats
+	stats.LogLength = len(m.opLog)
+	stats.Truncated = m.truncated
+	stats.Checkpoints = len(m.checkpoints)
+	stats.Tracked = len(m.moveOps)
+	return stats
+}
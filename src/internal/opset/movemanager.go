@@ -8,34 +8,43 @@ import (
 )
 
 type LogEntry struct {
-	op *Operation
+	op   *Operation
+	from *treeLocation // where the moved object was before, if the move was applied
 }
 
-type tempEntry struct {
-	entry LogEntry
-	isNew bool
+// treeLocation is where an object was in the document tree before a move
+type treeLocation struct {
+	parent   OpId
+	property any
 }
 
 type MoveManager struct {
-	opLog       *stack.Stack // element: LogEntry
+	opLog       []LogEntry // applied moves in OpId order, see movelog.go
+	checkpoints []moveCheckpoint
+	frontier    moveCheckpoint // where the moved objects were after the dropped log entries
+	truncated   int            // number of log entries dropped below the stable frontier
+	truncatedTo OpId           // the greatest dropped log entry
+	stats       MoveLogStats
 	valid       map[OpId]bool
 	tree        *DocumentTree
 	winners     map[OpId]*stack.Stack
 	moveIDMap   map[OpId]OpId
 	lifecycles  map[OpId]*LifeCycleList // key: object ID, value: its lifecycle
-	moveParents *stack.Stack            // element: OpId
+	moveOps     map[OpId]*Operation     // key: move ID, value: the move operation
 	ops         *OpSet
 }
 
 func NewMoveManager(ops *OpSet) *MoveManager {
 	lifecycles := make(map[OpId]*LifeCycleList)
 	moveManager := &MoveManager{
-		opLog:       stack.New(),
+		opLog:       make([]LogEntry, 0),
+		checkpoints: make([]moveCheckpoint, 0),
+		frontier:    newMoveCheckpoint(0),
 		tree:        NewDocumentTree(lifecycles),
 		winners:     make(map[OpId]*stack.Stack),
-		moveParents: stack.New(),
 		valid:       make(map[OpId]bool),
 		moveIDMap:   make(map[OpId]OpId),
+		moveOps:     make(map[OpId]*Operation),
 		lifecycles:  lifecycles,
 		ops:         ops,
 	}
@@ -45,6 +54,11 @@ func NewMoveManager(ops *OpSet) *MoveManager {
 }
 
 func (m *MoveManager) updateLifecycle(operation *Operation) {
+	if operation.Action == INCREMENT {
+		// an increment doesn't remove the counter it applies to
+		return
+	}
+	trashed := make(map[OpId]bool) // an object can be visible through several preds, e.g. a move and its make
 	for _, pred := range operation.Pred {
 		predObjID := pred
 		if moveID, ok := m.moveIDMap[pred]; ok {
@@ -57,10 +71,11 @@ func (m *MoveManager) updateLifecycle(operation *Operation) {
 				continue
 			}
 		}
-		if !m.IsValid(predObjID) {
+		if !m.IsValid(predObjID) || trashed[predObjID] {
 			continue
 		}
-		if lst, ok2 := m.lifecycles[pred]; ok2 {
+		trashed[predObjID] = true
+		if lst, ok2 := m.lifecycles[predObjID]; ok2 {
 			lst.insertTrash(operation.OpId)
 		} else {
 			panic("pred lifecycle not found")
@@ -78,38 +93,46 @@ func (m *MoveManager) updateLifecycle(operation *Operation) {
 func (m *MoveManager) apply(operation *Operation) {
 	log.MinimalTracef("tree:\n %s", m.tree.String)
 	log.MinimalTracef("Applying %s", operation.String)
-	logEntry := LogEntry{
-		op: operation,
-	}
 	if operation.Action == MOVE {
 		m.moveIDMap[operation.OpId.Id] = *operation.MovedID
-		m.opLog.Push(logEntry)
+		m.moveOps[operation.OpId.Id] = operation
 		mid := *operation.MovedID
 		oid := operation.ObjId
 		if _, ok := m.winners[mid]; !ok {
 			m.winners[mid] = stack.New()
 		}
 		if m.tree.isAncestorOf(operation.OpId, mid, oid) {
+			m.setWon(operation, false)
 			m.setValid(operation.OpId, false, "It introduces a cycle")
+			m.push(LogEntry{op: operation})
+			return
+		}
+		prevMove := m.winners[mid].Peek()
+		if prevMove != nil && prevMove.(*OpIdWithValid).Id.GreaterThan(m.ops, &operation.OpId.Id) {
+			// only a move older than the stable frontier comes after a greater one, see replay
+			m.setWon(operation, true)
+			m.setValid(operation.OpId, false, "It is older than the stable winner")
+			m.push(LogEntry{op: operation})
 			return
 		}
+		m.setWon(operation, true)
 		m.setValid(operation.OpId, true, "It is the winner")
-		m.moveParents.Push(m.tree.getParent(mid))
+		from := treeLocation{parent: m.tree.getParent(mid), property: m.tree.getProperty(mid)}
 		m.tree.updateParentAs(mid, oid)
 		m.tree.updateProperty(mid, operation.Prop)
-		prevMove := m.winners[mid].Peek()
 		if prevMove != nil {
 			temp := prevMove.(*OpIdWithValid)
 			m.setValid(temp, false, "It is not the winner anymore")
 		}
 		m.winners[mid].Push(operation.OpId)
+		m.push(LogEntry{op: operation, from: &from})
 	}
 }
 
 func (m *MoveManager) revert(logEntry LogEntry) {
 	log.MinimalTracef("tree:\n %s", m.tree.String)
 	log.MinimalTracef("Reverting %s", logEntry.op.String)
-	if logEntry.op.Action == MOVE && logEntry.op.OpId.Valid {
+	if logEntry.op.Action == MOVE && logEntry.from != nil {
 		moveStack := m.winners[*logEntry.op.MovedID]
 		moveStack.Pop()
 		// if it is not empty
@@ -117,86 +140,72 @@ func (m *MoveManager) revert(logEntry LogEntry) {
 			prevMove := moveStack.Peek().(*OpIdWithValid)
 			m.setValid(prevMove, true, "It is the winner again")
 		}
-		oldParent := m.moveParents.Pop().(OpId)
-		m.tree.updateParentAs(*logEntry.op.MovedID, oldParent)
-		m.tree.updateProperty(*logEntry.op.MovedID, logEntry.op.Prop)
+		m.tree.updateParentAs(*logEntry.op.MovedID, logEntry.from.parent)
+		m.tree.updateProperty(*logEntry.op.MovedID, logEntry.from.property)
 	}
 }
 
 func (m *MoveManager) BulkUpdateValidity(operations []*Operation) {
+	if len(operations) == 0 {
+		return
+	}
 	// sort by opId in ascending order
 	sort.Slice(operations, func(i, j int) bool {
 		return !operations[i].OpId.Id.GreaterThan(m.ops, &operations[j].OpId.Id)
 	})
-	currOp := len(operations) - 1
-	tempStack := stack.New()
 	// undo
-	for m.opLog.Len() > 0 && currOp >= 0 {
-		logEntry := m.opLog.Peek().(LogEntry)
-		if logEntry.op.OpId.Id.GreaterThan(m.ops, &operations[currOp].OpId.Id) {
-			tempStack.Push(tempEntry{entry: m.opLog.Pop().(LogEntry), isNew: false})
-			m.revert(logEntry)
+	undone := m.undo(operations[0].OpId.Id)
+
+	// bulk do & redo, in OpId order
+	for len(undone) > 0 || len(operations) > 0 {
+		if len(operations) > 0 && (len(undone) == 0 || undone[0].op.OpId.Id.GreaterThan(m.ops, &operations[0].OpId.Id)) {
+			m.apply(operations[0])
+			m.updateLifecycle(operations[0])
+			operations = operations[1:]
 		} else {
-			tempStack.Push(tempEntry{
-				entry: LogEntry{
-					op: operations[currOp],
-				},
-				isNew: true,
-			})
-			currOp--
+			m.apply(undone[0].op)
+			undone = undone[1:]
 		}
 	}
-	for currOp >= 0 {
-		tempStack.Push(tempEntry{
-			entry: LogEntry{
-				op: operations[currOp],
-			},
-			isNew: true,
-		})
-		currOp--
-	}
-
-	// bulk do & redo
-	for tempStack.Len() > 0 {
-		logEntry := tempStack.Pop().(tempEntry)
-		m.apply(logEntry.entry.op)
-		if logEntry.isNew {
-			m.updateLifecycle(logEntry.entry.op)
-		}
-	}
-
 }
 
 func (m *MoveManager) UpdateValidity(operation *Operation) {
 	log.MinimalTracef("UpdateValidity: %s", operation.String)
-	tempStack := stack.New()
-	// undo
-	for m.opLog.Len() > 0 {
-		logEntry := m.opLog.Peek().(LogEntry)
-		if logEntry.op.OpId.Id.GreaterThan(m.ops, &operation.OpId.Id) {
-			tempStack.Push(m.opLog.Pop())
-			m.revert(logEntry)
-		} else {
-			break
-		}
-	}
-	// do & redo
-	m.apply(operation)
-	m.updateLifecycle(operation)
-	for tempStack.Len() > 0 {
-		logEntry := tempStack.Pop().(LogEntry)
-		m.apply(logEntry.op)
-	}
+	m.BulkUpdateValidity([]*Operation{operation})
 }
 
 func (m *MoveManager) IsValid(opId OpId) bool {
 	if value, ok := m.valid[opId]; ok {
 		return value
+	} else if op, ok := m.ops.operations[opId]; ok && op.Action == MOVE {
+		return op.OpId.Valid // dropped together with its log entry
 	} else {
 		return true // PUT, MAKE, DELETE
 	}
 }
 
+// overwrites reports whether a successor hides the operations it overwrote. A move that won when it
+// was applied keeps hiding them after a later move of the same object wins, since the object
+// doesn't go back to where it was before.
+func (m *MoveManager) overwrites(succ OpId) bool {
+	if op, ok := m.ops.operations[succ]; ok && op.won {
+		return true
+	}
+	return m.IsValid(succ)
+}
+
+func (m *MoveManager) setWon(operation *Operation, won bool) {
+	if operation.won == won {
+		return
+	}
+	operation.won = won
+	for _, pred := range operation.Pred {
+		if predOp, ok := m.ops.operations[pred]; ok {
+			predOp.refreshVisibility()
+		}
+	}
+}
+
 func (m *MoveManager) Visualize() string {
 	return m.tree.Visualize()
 }
@@ -211,7 +220,17 @@ func (m *MoveManager) getParentAndProperty(id OpId) (OpId, any, error) {
 }
 
 func (m *MoveManager) setValid(id *OpIdWithValid, valid bool, reason string) {
-	logrus.Debugf("Set %s as %v: %s", id.Id.String(), valid, reason)
+	logrus.Debugf("Set %v as %v: %s", &id.Id, valid, reason) // formatted only if debug logging is on
+	changed := m.IsValid(id.Id) != valid || id.Valid != valid
 	m.valid[id.Id] = valid
 	id.Valid = valid
+	if op, ok := m.moveOps[id.Id]; ok && changed {
+		// the move and the operations it overwrites change visibility
+		op.refreshVisibility()
+		for _, pred := range op.Pred {
+			if predOp, ok := m.ops.operations[pred]; ok {
+				predOp.refreshVisibility()
+			}
+		}
+	}
 }
@@ -16,19 +16,35 @@ type Operation struct {
 	Pred    []OpId         `json:"Pred"`
 	Succ    []OpId         `json:"Succ"`
 	Insert  bool           `json:"Insert"`
+	Mark    *MarkRange     `json:"Mark,omitempty"`
+
+	increments []*Operation // INCREMENT operations applied to a counter
+	leaf       *seqNode     // leaf of the opSequence holding the operation
+	visible    bool         // visibility when the opSequence last refreshed the operation
+	groupOps   []*Operation // visible operations of the group the operation starts, in order
+	won        bool         // a move that won when it was applied
+}
+
+// ConflictValue is one of the values that are concurrently visible at a property or list element
+type ConflictValue struct {
+	Value any    // scalar value, or ExOpId of an object
+	OpId  ExOpId // operation that put the value there
 }
 
 type ExOperation struct {
-	OpId    ExOpId      `json:"OpId"`
-	ObjId   ExOpId      `json:"ObjId"`
-	Prop    any         `json:"Prop"`
-	Action  ActionType  `json:"Action"`
-	Value   interface{} `json:"Value"`
-	MovedID *ExOpId     `json:"MovedID"`
-	MoveSrc *ExOpId     `json:"MoveSrc"`
-	Pred    []ExOpId    `json:"Pred"`
-	Succ    []ExOpId    `json:"Succ"`
-	Insert  bool        `json:"Insert"`
+	OpId    ExOpId       `json:"OpId"`
+	ObjId   ExOpId       `json:"ObjId"`
+	Prop    any          `json:"Prop"`
+	Action  ActionType   `json:"Action"`
+	Value   interface{}  `json:"Value"`
+	MovedID *ExOpId      `json:"MovedID"`
+	MoveSrc *ExOpId      `json:"MoveSrc"`
+	Pred    []ExOpId     `json:"Pred"`
+	Succ    []ExOpId     `json:"Succ"`
+	Insert  bool         `json:"Insert"`
+	Mark    *ExMarkRange `json:"Mark,omitempty"`
+	// Datatype tells how to read Value when it is decoded from JSON, see value.go
+	Datatype string `json:"Datatype,omitempty"`
 }
 
 func (op *ExOperation) ToOp(s *OpSet) *Operation {
@@ -63,6 +79,12 @@ func (op *ExOperation) ToOp(s *OpSet) *Operation {
 	if value, ok := op.Value.(ExOpId); ok {
 		newOp.Value = *value.ToOpId(s)
 	}
+	if op.Mark != nil {
+		newOp.Mark = op.Mark.toMarkRange(s)
+	}
+	if op.Action != MAKE {
+		newOp.Value = decodeValue(newOp.Value, op.Datatype)
+	}
 	return newOp
 }
 
@@ -97,17 +119,28 @@ func (op *Operation) ToExOp(s *OpSet) *ExOperation {
 	if value, ok := op.Value.(OpId); ok {
 		newOp.Value = *value.ToExOpId(s)
 	}
+	if op.Mark != nil {
+		newOp.Mark = op.Mark.toExMarkRange(s)
+	}
+	newOp.Datatype = datatypeOf(op.Value)
 	return newOp
 }
 
+// Copy returns a copy of the operation for another OpSet, without the successors known in this one
+func (op *Operation) Copy(from *OpSet, to *OpSet) *Operation {
+	copied := op.ToExOp(from).ToOp(to)
+	copied.Succ = make([]OpId, 0)
+	return copied
+}
+
 func (op *Operation) isMoveVisible(moveManager *MoveManager) bool {
-	if op.Action == DELETE {
+	if op.Action == DELETE || op.Action == INCREMENT {
 		return false
 	}
-	// if it is valid, and all successors are invalid, then it is visible
+	// if it is valid, and no successor overwrites it, then it is visible
 	if op.OpId.Valid {
 		for _, succ := range op.Succ {
-			if moveManager.IsValid(succ) {
+			if moveManager.overwrites(succ) {
 				return false
 			}
 		}
@@ -121,7 +154,7 @@ func (op *Operation) isVisible(moveManager *MoveManager) bool {
 	if MoveEnabled {
 		return op.isMoveVisible(moveManager)
 	} else {
-		if op.Action == DELETE {
+		if op.Action == DELETE || op.Action == INCREMENT {
 			return false
 		}
 		return len(op.Succ) == 0
@@ -135,6 +168,7 @@ func (op *Operation) addSuccessor(succ OpId) {
 		}
 	}
 	op.Succ = append(op.Succ, succ)
+	op.refreshVisibility()
 }
 
 func (op *Operation) overwrites(other *Operation) bool {
@@ -146,6 +180,22 @@ func (op *Operation) overwrites(other *Operation) bool {
 	return false
 }
 
+// visibleValue returns what a visible operation stands for at its key or list element: either the
+// id of an object or a scalar value
+func (op *Operation) visibleValue() (value any, isObject bool) {
+	switch op.Action {
+	case MAKE:
+		return op.OpId.Id, true
+	case MOVE:
+		if op.Value != nil {
+			return op.withIncrements(op.Value), false
+		}
+		return *op.MovedID, true
+	default:
+		return op.withIncrements(op.Value), false
+	}
+}
+
 func (op *Operation) isMovingScalar() bool {
 	if op.Action == MOVE && op.Value != nil {
 		return true
@@ -186,7 +236,7 @@ func (op *Operation) visualize() string {
 func covertToExOpId(jsonMap map[string]any) ExOpId {
 	actorIdStr := jsonMap["ActorId"].(string)
 	actorId, _ := uuid.Parse(actorIdStr)
-	counter := uint64(jsonMap["Counter"].(float64))
+	counter := toUint64(jsonMap["Counter"])
 	return ExOpId{actorId, counter}
 }
 
@@ -225,6 +275,16 @@ func (op *Operation) String() string {
 			}
 			return result
 		}
+	case INCREMENT:
+		{
+			result += fmt.Sprintf("Increment %v by %v", op.Pred, op.Value)
+			return result
+		}
+	case MARK:
+		{
+			result += fmt.Sprintf("Mark %v of %v as %v, from %v to %v", op.Prop, op.ObjId.String(), op.Value, op.Mark.Start, op.Mark.End)
+			return result
+		}
 	case DELETE:
 		{
 			result += fmt.Sprintf("Delete %v", op.Pred)
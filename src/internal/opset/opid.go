@@ -39,6 +39,15 @@ func (ex *ExOpId) ToOpId(s *OpSet) *OpId {
 	}
 }
 
+// Lookup converts an ExOpId without registering unknown actors, so it is safe for concurrent readers
+func (ex *ExOpId) Lookup(s *OpSet) (OpId, bool) {
+	index, ok := s.actorIdMap[ex.ActorId]
+	if !ok {
+		return OpId{}, false
+	}
+	return OpId{ActorId: uint(index), Counter: ex.Counter}, true
+}
+
 func (opId *OpId) ToExOpId(s *OpSet) *ExOpId {
 	if opId == nil {
 		return nil
@@ -58,7 +67,8 @@ func (opId *OpId) GreaterThan(s *OpSet, opId2 *OpId) bool {
 	if opId.Counter > opId2.Counter {
 		return true
 	} else if opId.Counter == opId2.Counter {
-		return s.GetActorId(opId.ActorId).String() > s.GetActorId(opId2.ActorId).String()
+		// the rank orders actors like their ids, as formatted strings or as bytes
+		return s.actorRanks[opId.ActorId] > s.actorRanks[opId2.ActorId]
 	} else {
 		return false
 	}
@@ -72,6 +82,10 @@ func (opId *OpId) String() string {
 	return fmt.Sprintf("%v@%v", opId.Counter, opId.ActorId)
 }
 
+func (ex ExOpId) String() string {
+	return fmt.Sprintf("%v@%v", ex.Counter, ex.ActorId)
+}
+
 func (ex *ExOpId) EqualsTo(other *ExOpId) bool {
 	return ex.ActorId == other.ActorId && ex.Counter == other.Counter
 }
@@ -0,0 +1,586 @@
+package opset
+
+// opSequence stores the operations of an OpTree in order. It is a B-tree whose nodes count the
+// operations and the visible groups below them, so that positions and the n-th visible list element
+// or map property are found in O(log n). A group is a list element, starting with its insert
+// operation, or the operations of one map property. The visible operations of a group are kept at
+// its first operation and updated whenever an operation of it changes visibility. For texts the
+// nodes also add up the width of the visible elements, so that positions in the text are found in
+// O(log n) as well.
+type opSequence struct {
+	root *seqNode
+	tree *OpTree
+}
+
+const seqMaxLeaf = 64
+const seqMaxChildren = 32
+
+type seqNode struct {
+	parent     *seqNode
+	children   []*seqNode   // inner nodes
+	ops        []*Operation // leaves
+	prev, next *seqNode     // neighbouring leaves
+	size       int          // number of operations below
+	visible    int          // number of visible groups below
+	units      [2]int       // width of the visible text elements below, per TextEncoding
+	seq        *opSequence
+}
+
+// seqElement points to an operation of an opSequence, like list.Element does for a list.List
+type seqElement struct {
+	Value any
+	leaf  *seqNode
+	index int
+}
+
+func newOpSequence(tree *OpTree) *opSequence {
+	seq := &opSequence{tree: tree}
+	seq.root = &seqNode{seq: seq}
+	return seq
+}
+
+func (seq *opSequence) Len() int {
+	return seq.root.size
+}
+
+// Visible returns the number of visible groups
+func (seq *opSequence) Visible() int {
+	return seq.root.visible
+}
+
+func (seq *opSequence) firstLeaf() *seqNode {
+	node := seq.root
+	for node.children != nil {
+		node = node.children[0]
+	}
+	return node
+}
+
+func newSeqElement(leaf *seqNode, index int) *seqElement {
+	for leaf != nil && index >= len(leaf.ops) {
+		leaf, index = leaf.next, 0
+	}
+	if leaf == nil {
+		return nil
+	}
+	return &seqElement{Value: leaf.ops[index], leaf: leaf, index: index}
+}
+
+func (seq *opSequence) Front() *seqElement {
+	return newSeqElement(seq.firstLeaf(), 0)
+}
+
+func (e *seqElement) Next() *seqElement {
+	return newSeqElement(e.leaf, e.index+1)
+}
+
+func (e *seqElement) Prev() *seqElement {
+	leaf, index := e.leaf, e.index-1
+	for leaf != nil && index < 0 {
+		leaf = leaf.prev
+		if leaf != nil {
+			index = len(leaf.ops) - 1
+		}
+	}
+	if leaf == nil {
+		return nil
+	}
+	return &seqElement{Value: leaf.ops[index], leaf: leaf, index: index}
+}
+
+// elementOf returns the element of an operation of the sequence
+func (seq *opSequence) elementOf(op *Operation) *seqElement {
+	for i, other := range op.leaf.ops {
+		if other == op {
+			return &seqElement{Value: op, leaf: op.leaf, index: i}
+		}
+	}
+	panic("operation is not in its leaf")
+}
+
+// At returns the element at a position, or nil at the end
+func (seq *opSequence) At(pos int) *seqElement {
+	if pos < 0 || pos >= seq.Len() {
+		return nil
+	}
+	node := seq.root
+	for node.children != nil {
+		for _, child := range node.children {
+			if pos < child.size {
+				node = child
+				break
+			}
+			pos -= child.size
+		}
+	}
+	return &seqElement{Value: node.ops[pos], leaf: node, index: pos}
+}
+
+// Position returns the position of an operation of the sequence
+func (seq *opSequence) Position(op *Operation) int {
+	pos := seq.elementOf(op).index
+	for node := op.leaf; node.parent != nil; node = node.parent {
+		for _, sibling := range node.parent.children {
+			if sibling == node {
+				break
+			}
+			pos += sibling.size
+		}
+	}
+	return pos
+}
+
+// Search returns the first position and element whose operation satisfies f, which must be false
+// for the operations before it and true from there on, like sort.Search. The element is nil if there
+// is no such operation.
+func (seq *opSequence) Search(f func(op *Operation) bool) (int, *seqElement) {
+	pos := 0
+	node := seq.root
+	for node.children != nil {
+		// the result is in the last child whose first operation doesn't satisfy f
+		next := node.children[0]
+		for _, child := range node.children[1:] {
+			if f(child.first()) {
+				break
+			}
+			pos += next.size
+			next = child
+		}
+		node = next
+	}
+	for i, op := range node.ops {
+		if f(op) {
+			return pos + i, &seqElement{Value: op, leaf: node, index: i}
+		}
+	}
+	return pos + len(node.ops), newSeqElement(node.next, 0)
+}
+
+func (node *seqNode) first() *Operation {
+	for node.children != nil {
+		node = node.children[0]
+	}
+	return node.ops[0]
+}
+
+// VisibleBefore returns the number of visible groups that start before an operation
+func (seq *opSequence) VisibleBefore(op *Operation) int {
+	visible, _ := seq.before(op)
+	return visible
+}
+
+// UnitsBefore returns the width of the visible text elements before an operation
+func (seq *opSequence) UnitsBefore(op *Operation, encoding TextEncoding) int {
+	_, units := seq.before(op)
+	return units[encoding]
+}
+
+func (seq *opSequence) before(op *Operation) (int, [2]int) {
+	visible, units := 0, [2]int{}
+	for _, other := range op.leaf.ops {
+		if other == op {
+			break
+		}
+		v, u := seq.weight(other)
+		visible, units = visible+v, addUnits(units, u, 1)
+	}
+	for node := op.leaf; node.parent != nil; node = node.parent {
+		for _, sibling := range node.parent.children {
+			if sibling == node {
+				break
+			}
+			visible, units = visible+sibling.visible, addUnits(units, sibling.units, 1)
+		}
+	}
+	return visible, units
+}
+
+// NthVisible returns the first operation of the n-th visible group, or nil
+func (seq *opSequence) NthVisible(n int) *seqElement {
+	if n < 0 || n >= seq.Visible() {
+		return nil
+	}
+	node := seq.root
+	for node.children != nil {
+		for _, child := range node.children {
+			if n < child.visible {
+				node = child
+				break
+			}
+			n -= child.visible
+		}
+	}
+	for i, op := range node.ops {
+		if op.groupVisible() {
+			if n == 0 {
+				return &seqElement{Value: op, leaf: node, index: i}
+			}
+			n--
+		}
+	}
+	panic("visible count of a leaf is wrong")
+}
+
+// Units returns the width of the visible text elements
+func (seq *opSequence) Units(encoding TextEncoding) int {
+	return seq.root.units[encoding]
+}
+
+// AtUnits returns the index of the visible group that covers a position counted in the units of a
+// text encoding, and the position the group starts at. Past the last group it returns the number of
+// visible groups and the width of all of them.
+func (seq *opSequence) AtUnits(pos int, encoding TextEncoding) (int, int) {
+	if pos >= seq.Units(encoding) {
+		return seq.Visible(), seq.Units(encoding)
+	}
+	index, start := 0, 0
+	node := seq.root
+	for node.children != nil {
+		for _, child := range node.children {
+			if pos < start+child.units[encoding] {
+				node = child
+				break
+			}
+			index, start = index+child.visible, start+child.units[encoding]
+		}
+	}
+	for _, op := range node.ops {
+		visible, units := seq.weight(op)
+		if pos < start+units[encoding] {
+			return index, start
+		}
+		index, start = index+visible, start+units[encoding]
+	}
+	panic("units count of a leaf is wrong")
+}
+
+// InsertBefore inserts an operation before an element, or at the end if the element is nil
+func (seq *opSequence) InsertBefore(op *Operation, element *seqElement) {
+	if element == nil {
+		seq.PushBack(op)
+		return
+	}
+	seq.insertInLeaf(op, element.leaf, element.index)
+}
+
+func (seq *opSequence) PushBack(op *Operation) {
+	leaf := seq.firstLeaf()
+	for leaf.next != nil {
+		leaf = leaf.next
+	}
+	seq.insertInLeaf(op, leaf, len(leaf.ops))
+}
+
+// InsertAt inserts an operation at a position
+func (seq *opSequence) InsertAt(pos int, op *Operation) {
+	if element := seq.At(pos); element != nil {
+		seq.insertInLeaf(op, element.leaf, element.index)
+	} else {
+		seq.PushBack(op)
+	}
+}
+
+func (seq *opSequence) insertInLeaf(op *Operation, leaf *seqNode, index int) {
+	leaf.ops = append(leaf.ops, nil)
+	copy(leaf.ops[index+1:], leaf.ops[index:])
+	leaf.ops[index] = op
+	op.leaf = leaf
+	op.visible, op.groupOps = false, nil
+	for node := leaf; node != nil; node = node.parent {
+		node.size++
+	}
+	if len(leaf.ops) > seqMaxLeaf {
+		seq.split(leaf)
+	}
+	// the operation may have become the first one of a map property that started after it
+	if next := seq.elementOf(op).Next(); next != nil && seq.tree.Type == MAP && seq.head(op) == op {
+		if nextOp := next.Value.(*Operation); nextOp.Prop == op.Prop {
+			groupOps := nextOp.groupOps
+			seq.setGroupOps(nextOp, nil)
+			seq.setGroupOps(op, groupOps)
+		}
+	}
+	seq.refresh(op)
+}
+
+// split moves the second half of a node into a new sibling
+func (seq *opSequence) split(node *seqNode) {
+	sibling := &seqNode{seq: seq, parent: node.parent}
+	if node.children == nil {
+		half := len(node.ops) / 2
+		sibling.ops = append([]*Operation{}, node.ops[half:]...)
+		node.ops = node.ops[:half:half]
+		for _, op := range sibling.ops {
+			op.leaf = sibling
+		}
+		sibling.prev, sibling.next = node, node.next
+		if node.next != nil {
+			node.next.prev = sibling
+		}
+		node.next = sibling
+	} else {
+		half := len(node.children) / 2
+		sibling.children = append([]*seqNode{}, node.children[half:]...)
+		node.children = node.children[:half:half]
+		for _, child := range sibling.children {
+			child.parent = sibling
+		}
+	}
+	node.recount()
+	sibling.recount()
+
+	if node.parent == nil {
+		seq.root = &seqNode{seq: seq, children: []*seqNode{node, sibling}}
+		node.parent, sibling.parent = seq.root, seq.root
+		seq.root.recount()
+		return
+	}
+	parent := node.parent
+	for i, child := range parent.children {
+		if child == node {
+			parent.children = append(parent.children, nil)
+			copy(parent.children[i+2:], parent.children[i+1:])
+			parent.children[i+1] = sibling
+			break
+		}
+	}
+	if len(parent.children) > seqMaxChildren {
+		seq.split(parent)
+	}
+}
+
+func (node *seqNode) recount() {
+	node.size, node.visible, node.units = 0, 0, [2]int{}
+	if node.children == nil {
+		node.size = len(node.ops)
+		for _, op := range node.ops {
+			visible, units := node.seq.weight(op)
+			node.visible, node.units = node.visible+visible, addUnits(node.units, units, 1)
+		}
+		return
+	}
+	for _, child := range node.children {
+		node.size += child.size
+		node.visible += child.visible
+		node.units = addUnits(node.units, child.units, 1)
+	}
+}
+
+// Remove removes an operation of the sequence
+func (seq *opSequence) Remove(op *Operation) {
+	seq.setVisible(op, false)
+	if next := seq.elementOf(op).Next(); next != nil && seq.tree.Type == MAP && seq.head(op) == op {
+		// the next operation becomes the first one of the property
+		if nextOp := next.Value.(*Operation); nextOp.Prop == op.Prop {
+			seq.setGroupOps(nextOp, op.groupOps)
+		}
+	}
+	seq.setGroupOps(op, nil)
+
+	leaf := op.leaf
+	element := seq.elementOf(op)
+	leaf.ops = append(leaf.ops[:element.index], leaf.ops[element.index+1:]...)
+	if len(leaf.ops) == 0 {
+		leaf.ops = nil
+	}
+	for node := leaf; node != nil; node = node.parent {
+		node.size--
+	}
+	op.leaf = nil
+	seq.rebalance(leaf)
+}
+
+// entries returns the number of operations of a leaf or children of an inner node
+func (node *seqNode) entries() int {
+	if node.children == nil {
+		return len(node.ops)
+	}
+	return len(node.children)
+}
+
+// rebalance merges a node that became less than a quarter full with a neighbouring sibling, or
+// moves entries over from the sibling if they don't fit into one node
+func (seq *opSequence) rebalance(node *seqNode) {
+	parent := node.parent
+	if parent == nil {
+		if len(node.children) == 1 {
+			seq.root = node.children[0]
+			seq.root.parent = nil
+		}
+		return
+	}
+	maxEntries := seqMaxChildren
+	if node.children == nil {
+		maxEntries = seqMaxLeaf
+	}
+	if node.entries() >= maxEntries/4 {
+		return
+	}
+	i := 0
+	for parent.children[i] != node {
+		i++
+	}
+	left, right := node, parent.children[len(parent.children)-1]
+	if i > 0 {
+		left, right = parent.children[i-1], node
+	} else if len(parent.children) > 1 {
+		right = parent.children[1]
+	} else {
+		return
+	}
+	if left.entries()+right.entries() <= maxEntries {
+		seq.merge(left, right)
+		seq.rebalance(parent)
+	} else {
+		seq.redistribute(left, right)
+	}
+}
+
+// merge moves the entries of a node into its left sibling and removes it
+func (seq *opSequence) merge(left *seqNode, right *seqNode) {
+	if left.children == nil {
+		for _, op := range right.ops {
+			op.leaf = left
+		}
+		left.ops = append(left.ops, right.ops...)
+		left.next = right.next
+		if right.next != nil {
+			right.next.prev = left
+		}
+	} else {
+		for _, child := range right.children {
+			child.parent = left
+		}
+		left.children = append(left.children, right.children...)
+	}
+	left.recount()
+	parent := right.parent
+	for i, child := range parent.children {
+		if child == right {
+			parent.children = append(parent.children[:i], parent.children[i+1:]...)
+			break
+		}
+	}
+}
+
+// redistribute splits the entries of two neighbouring siblings evenly between them
+func (seq *opSequence) redistribute(left *seqNode, right *seqNode) {
+	if left.children == nil {
+		ops := append(append([]*Operation{}, left.ops...), right.ops...)
+		half := len(ops) / 2
+		left.ops = append([]*Operation{}, ops[:half]...)
+		right.ops = append([]*Operation{}, ops[half:]...)
+		for _, op := range right.ops {
+			op.leaf = right
+		}
+		for _, op := range left.ops {
+			op.leaf = left
+		}
+	} else {
+		children := append(append([]*seqNode{}, left.children...), right.children...)
+		half := len(children) / 2
+		left.children = append([]*seqNode{}, children[:half]...)
+		right.children = append([]*seqNode{}, children[half:]...)
+		for _, child := range right.children {
+			child.parent = right
+		}
+		for _, child := range left.children {
+			child.parent = left
+		}
+	}
+	left.recount()
+	right.recount()
+}
+
+// head returns the first operation of the group of an operation, which is the insert operation of a
+// list element or the first operation of a map property
+func (seq *opSequence) head(op *Operation) *Operation {
+	if seq.tree.Type == MAP {
+		_, element := seq.tree.findStart(op.Prop.(string))
+		return element.Value.(*Operation)
+	}
+	if op.Insert {
+		return op
+	}
+	return seq.tree.ops.operations[op.elementId()]
+}
+
+// groupVisible reports whether an operation starts a group with visible operations
+func (op *Operation) groupVisible() bool {
+	return len(op.groupOps) > 0
+}
+
+// weight returns what the group an operation starts counts for in the visible and units counts
+func (seq *opSequence) weight(op *Operation) (int, [2]int) {
+	if len(op.groupOps) == 0 {
+		return 0, [2]int{}
+	}
+	if seq.tree.Type != TEXT {
+		return 1, [2]int{}
+	}
+	value, _ := op.groupOps[len(op.groupOps)-1].visibleValue()
+	return 1, [2]int{CodePoint.width(value), UTF16.width(value)}
+}
+
+func addUnits(units [2]int, other [2]int, sign int) [2]int {
+	return [2]int{units[0] + sign*other[0], units[1] + sign*other[1]}
+}
+
+// setGroupOps replaces the visible operations of the group head starts and updates the counts
+func (seq *opSequence) setGroupOps(head *Operation, groupOps []*Operation) {
+	oldVisible, oldUnits := seq.weight(head)
+	if len(groupOps) == 0 {
+		groupOps = nil
+	}
+	head.groupOps = groupOps
+	visible, units := seq.weight(head)
+	if visible == oldVisible && units == oldUnits {
+		return
+	}
+	units = addUnits(units, oldUnits, -1)
+	for node := head.leaf; node != nil; node = node.parent {
+		node.visible += visible - oldVisible
+		node.units = addUnits(node.units, units, 1)
+	}
+}
+
+// refresh updates the visible operations of the group of an operation after its visibility changed
+func (seq *opSequence) refresh(op *Operation) {
+	if op.leaf != nil {
+		seq.setVisible(op, op.isVisible(seq.tree.ops.moveManager))
+	}
+}
+
+func (seq *opSequence) setVisible(op *Operation, visible bool) {
+	if op.visible == visible {
+		return
+	}
+	op.visible = visible
+	if observer := seq.tree.ops.observer; observer != nil {
+		observer.changed(op, !visible)
+	}
+	head := seq.head(op)
+	// the visible operations of a group are kept in the order of the sequence, which is by id
+	groupOps := make([]*Operation, 0, len(head.groupOps)+1)
+	added := !visible
+	for _, other := range head.groupOps {
+		if !added && other.OpId.Id.GreaterThan(seq.tree.ops, &op.OpId.Id) {
+			groupOps = append(groupOps, op)
+			added = true
+		}
+		if other != op {
+			groupOps = append(groupOps, other)
+		}
+	}
+	if !added {
+		groupOps = append(groupOps, op)
+	}
+	seq.setGroupOps(head, groupOps)
+}
+
+// refreshVisibility updates the visible counts after the visibility of an operation changed
+func (op *Operation) refreshVisibility() {
+	if op.leaf != nil {
+		op.leaf.seq.refresh(op)
+	}
+}
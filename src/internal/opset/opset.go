@@ -1,6 +1,7 @@
 package opset
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/LiangrunDa/AutomergeWithMove/errors"
 	"github.com/awalterschulze/gographviz"
@@ -8,6 +9,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"math/rand"
 	"sort"
+	"strings"
 )
 
 var MoveEnabled = true
@@ -20,6 +22,11 @@ type OpSet struct {
 	moveManager   *MoveManager
 	actorIds      []uuid.UUID
 	actorIdMap    map[uuid.UUID]int
+	actorRanks    []int  // position of every actor in the order of their ids, by index
+	sortedActors  []uint // actor indexes in the order of their ids
+	textEncoding  TextEncoding
+	operations    map[OpId]*Operation // every operation of the op trees by its id
+	observer      *Observer           // records visibility changes for patches, if there are subscribers
 }
 
 func NewOpSet(actorId uuid.UUID) *OpSet {
@@ -38,7 +45,12 @@ func NewOpSet(actorId uuid.UUID) *OpSet {
 		lamportClock: lamportClock,
 		actorIds:     actorIds,
 		actorIdMap:   actorIdMap,
+		actorRanks:   make([]int, 0),
+		sortedActors: make([]uint, 0),
+		operations:   make(map[OpId]*Operation),
 	}
+	newSet.rankActor(0)
+	newSet.rankActor(1)
 	newSet.moveManager = NewMoveManager(newSet)
 	opTrees[RootOpId] = NewOpTree(actorId, lamportClock, MAP, RootOpId, newSet)
 	return newSet
@@ -58,10 +70,52 @@ func (s *OpSet) GetIdx(actorId uuid.UUID) uint {
 	} else {
 		s.actorIds = append(s.actorIds, actorId)
 		s.actorIdMap[actorId] = len(s.actorIds) - 1
+		s.rankActor(uint(len(s.actorIds) - 1))
 		return uint(len(s.actorIds) - 1)
 	}
 }
 
+// ActorCount returns the number of actors known to the OpSet
+func (s *OpSet) ActorCount() int {
+	return len(s.actorIds)
+}
+
+// ForgetActors removes the actors registered after the first count ones. No operation may refer to
+// them, e.g. because decoding the changes that introduced them failed.
+func (s *OpSet) ForgetActors(count int) {
+	for _, actorId := range s.actorIds[count:] {
+		delete(s.actorIdMap, actorId)
+	}
+	s.actorIds = s.actorIds[:count]
+	sorted := make([]uint, 0, count)
+	for _, index := range s.sortedActors {
+		if int(index) < count {
+			sorted = append(sorted, index)
+		}
+	}
+	s.sortedActors = sorted
+	s.actorRanks = s.actorRanks[:count]
+	for i, index := range s.sortedActors {
+		s.actorRanks[index] = i
+	}
+}
+
+// rankActor inserts a new actor into the actor order, so that OpIds with equal counters are
+// compared by rank instead of by formatting their actor ids
+func (s *OpSet) rankActor(index uint) {
+	actorId := s.actorIds[index]
+	pos := sort.Search(len(s.sortedActors), func(i int) bool {
+		return bytes.Compare(s.actorIds[s.sortedActors[i]][:], actorId[:]) > 0
+	})
+	s.sortedActors = append(s.sortedActors, 0)
+	copy(s.sortedActors[pos+1:], s.sortedActors[pos:])
+	s.sortedActors[pos] = index
+	s.actorRanks = append(s.actorRanks, 0)
+	for i := pos; i < len(s.sortedActors); i++ {
+		s.actorRanks[s.sortedActors[i]] = i
+	}
+}
+
 func (s *OpSet) GetActorId(index uint) uuid.UUID {
 	return s.actorIds[index]
 }
@@ -81,36 +135,201 @@ func (s *OpSet) GetLamportClock() *OpId {
 	return s.lamportClock
 }
 
+func (s *OpSet) getTree(objId OpId) (*OpTree, error) {
+	if tree, ok := s.opTrees[objId]; ok {
+		return tree, nil
+	}
+	return nil, errors.ObjectNotFoundError{ObjId: objId.String()}
+}
+
 func (s *OpSet) Get(objId OpId, propertyOrIndex any) (any, error) {
-	tree := s.opTrees[objId]
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return nil, err
+	}
+	if tree.Type == MAP {
+		if property, ok := propertyOrIndex.(string); ok {
+			return tree.MapGet(property)
+		}
+		return nil, errors.InvalidOperationError{Reason: "cannot get index on a map"}
+	} else {
+		if index, ok := propertyOrIndex.(int); ok {
+			return tree.ListGet(index)
+		}
+		return nil, errors.InvalidOperationError{Reason: "cannot get property on a list"}
+	}
+}
+
+// GetAll returns every value concurrently visible at a property or list element. The last one is
+// the value returned by Get.
+func (s *OpSet) GetAll(objId OpId, propertyOrIndex any) ([]ConflictValue, error) {
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return nil, err
+	}
+	var operations []*Operation
 	if tree.Type == MAP {
-		return tree.MapGet(propertyOrIndex.(string))
+		property, ok := propertyOrIndex.(string)
+		if !ok {
+			return nil, errors.InvalidOperationError{Reason: "cannot get index on a map"}
+		}
+		operations, _ = tree.search(property)
+	} else {
+		index, ok := propertyOrIndex.(int)
+		if !ok {
+			return nil, errors.InvalidOperationError{Reason: "cannot get property on a list"}
+		}
+		if operations, _ = tree.nth(index); len(operations) == 0 {
+			return nil, errors.ListIndexExceedsLengthError{Index: index}
+		}
+	}
+	values := make([]ConflictValue, 0, len(operations))
+	for _, op := range operations {
+		value, _ := op.visibleValue()
+		values = append(values, ConflictValue{
+			Value: s.ToExValue(value),
+			OpId:  *op.OpId.Id.ToExOpId(s),
+		})
+	}
+	return values, nil
+}
+
+// ToExValue converts the object ids in a value returned by Get to ExOpIds
+func (s *OpSet) ToExValue(value any) any {
+	if v, ok := value.(*OpIdWithValid); ok {
+		return *v.Id.ToExOpId(s)
+	} else if v, ok := value.(OpId); ok {
+		return *v.ToExOpId(s)
 	} else {
-		return tree.ListGet(propertyOrIndex.(int))
+		return value
 	}
 }
 
+func (s *OpSet) Keys(objId OpId) ([]string, error) {
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return nil, err
+	}
+	if tree.Type != MAP {
+		return nil, errors.InvalidOperationError{Reason: "cannot get keys of a list"}
+	}
+	return tree.MapKeys(), nil
+}
+
+// KeysInRange returns the visible properties of a map from from up to but excluding to, in sorted
+// order. An empty to means up to the last property.
+func (s *OpSet) KeysInRange(objId OpId, from string, to string) ([]string, error) {
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return nil, err
+	}
+	if tree.Type != MAP {
+		return nil, errors.InvalidOperationError{Reason: "cannot get keys of a list"}
+	}
+	return tree.mapKeysFrom(from, func(prop string) bool {
+		return to == "" || prop < to
+	}), nil
+}
+
+// KeysWithPrefix returns the visible properties of a map that start with prefix, in sorted order
+func (s *OpSet) KeysWithPrefix(objId OpId, prefix string) ([]string, error) {
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return nil, err
+	}
+	if tree.Type != MAP {
+		return nil, errors.InvalidOperationError{Reason: "cannot get keys of a list"}
+	}
+	return tree.mapKeysFrom(prefix, func(prop string) bool {
+		return strings.HasPrefix(prop, prefix)
+	}), nil
+}
+
+func (s *OpSet) Length(objId OpId) (int, error) {
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return 0, err
+	}
+	if tree.Type == MAP {
+		return tree.operations.Visible(), nil
+	} else if tree.Type == TEXT {
+		return tree.textLength(), nil
+	}
+	return tree.ListLength(), nil
+}
+
+// Values returns the values of a map in key order, or the elements of a list
+func (s *OpSet) Values(objId OpId) ([]any, error) {
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]any, 0)
+	if tree.Type == MAP {
+		for _, key := range tree.MapKeys() {
+			operations, _ := tree.search(key)
+			value, _ := operations[len(operations)-1].visibleValue()
+			values = append(values, s.ToExValue(value))
+		}
+	} else {
+		for _, operations := range tree.listElements() {
+			value, _ := operations[len(operations)-1].visibleValue()
+			values = append(values, s.ToExValue(value))
+		}
+	}
+	return values, nil
+}
+
+func (s *OpSet) ObjectType(objId OpId) (ObjType, error) {
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return 0, err
+	}
+	return tree.Type, nil
+}
+
 func (s *OpSet) Put(objId OpId, propertyOrIndex any, value any) error {
-	tree := s.opTrees[objId]
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return err
+	}
 	if tree.Type == MAP {
-		tree.MapPut(propertyOrIndex.(string), value)
-		return nil
+		if property, ok := propertyOrIndex.(string); ok {
+			tree.MapPut(property, value)
+			return nil
+		}
+		return errors.InvalidOperationError{Reason: "cannot put index on a map"}
 	} else {
-		return tree.ListPut(propertyOrIndex.(int), value)
+		if index, ok := propertyOrIndex.(int); ok {
+			return tree.ListPut(index, value)
+		}
+		return errors.InvalidOperationError{Reason: "cannot put property on a list"}
 	}
 }
 
 func (s *OpSet) Delete(objId OpId, propertyOrIndex any) error {
-	tree := s.opTrees[objId]
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return err
+	}
 	if tree.Type == MAP {
-		return tree.MapDelete(propertyOrIndex.(string))
+		if property, ok := propertyOrIndex.(string); ok {
+			return tree.MapDelete(property)
+		}
+		return errors.InvalidOperationError{Reason: "cannot delete index on a map"}
 	} else {
-		return tree.ListDelete(propertyOrIndex.(int))
+		if index, ok := propertyOrIndex.(int); ok {
+			return tree.ListDelete(index)
+		}
+		return errors.InvalidOperationError{Reason: "cannot delete property on a list"}
 	}
 }
 
 func (s *OpSet) PutObject(objId OpId, property string, objType ObjType) (OpId, error) {
-	tree := s.opTrees[objId]
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return OpId{}, err
+	}
 	if tree.Type == MAP {
 		operations, insertIdx := tree.search(property)
 		pred := make([]OpId, 0)
@@ -145,18 +364,25 @@ func (s *OpSet) PutObject(objId OpId, property string, objType ObjType) (OpId, e
 }
 
 func (s *OpSet) Insert(objId OpId, index int, value any) error {
-	tree := s.opTrees[objId]
-	if tree.Type == LIST {
-		tree.ListInsert(index, value)
-		return nil
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return err
+	}
+	if tree.Type != MAP {
+		return tree.ListInsert(index, value)
 	} else {
 		return errors.InvalidOperationError{Reason: "cannot insert value on a map"}
 	}
 }
 
 func (s *OpSet) InsertObject(objId OpId, index int, objType ObjType) (OpId, error) {
-	tree := s.opTrees[objId]
-	if tree.Type == LIST {
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return OpId{}, err
+	}
+	if tree.Type == TEXT {
+		return OpId{}, errors.InvalidOperationError{Reason: "cannot insert object on a text"}
+	} else if tree.Type == LIST {
 		if insertRowNumber, insertProp, err := tree.insertNth(index); err == nil {
 			newObjId := tree.lamportClock.increment()
 			localOp := Operation{
@@ -182,16 +408,18 @@ func (s *OpSet) InsertObject(objId OpId, index int, objType ObjType) (OpId, erro
 
 func (s *OpSet) InsertOperation(operation *Operation) {
 	tree := s.opTrees[operation.ObjId]
-	if tree.Type == MAP {
+	if operation.Action == MARK {
+		tree.insertMark(operation)
+	} else if tree.Type == MAP {
 		if pos, found, pred := tree.MapSeekOperation(operation); !found {
 
 			tree.insertOpWithValidityUpdate(operation, pos, false)
 			for _, op := range pred {
-				op.addSuccessor(operation.OpId.Id)
+				op.addSuccessorOp(operation)
 			}
 
 			if operation.Action == MAKE {
-				objType := (ObjType)(operation.Value.(float64))
+				objType := ObjTypeOf(operation.Value)
 				s.opTrees[operation.OpId.Id] = NewOpTree(s.actorId, s.lamportClock, objType, operation.OpId.Id, s)
 			} else if operation.Action == MOVE {
 				//update source predecessors' successor field
@@ -204,10 +432,10 @@ func (s *OpSet) InsertOperation(operation *Operation) {
 		if pos, found, pred := tree.ListSeekOperation(operation); !found {
 			tree.insertOpWithValidityUpdate(operation, pos, false)
 			for _, op := range pred {
-				op.addSuccessor(operation.OpId.Id)
+				op.addSuccessorOp(operation)
 			}
 			if operation.Action == MAKE {
-				objType := (ObjType)(operation.Value.(float64))
+				objType := ObjTypeOf(operation.Value)
 				s.opTrees[operation.OpId.Id] = NewOpTree(s.actorId, s.lamportClock, objType, operation.OpId.Id, s)
 			} else if operation.Action == MOVE {
 				//update source predecessors' successor field
@@ -305,8 +533,14 @@ func (s *OpSet) moveToList(MovedFrom OpId, dstTree *OpTree, index int, ObjIdToBe
 
 func (s *OpSet) GenericMove(srcObjId OpId, dstObjId OpId, srcPropertyOrIndex any, dstPropertyOrIndex any) error {
 	logrus.Tracef("Try to move %v:%v to %v:%v", srcObjId, srcPropertyOrIndex, dstObjId, dstPropertyOrIndex)
-	srcTree := s.opTrees[srcObjId]
-	dstTree := s.opTrees[dstObjId]
+	srcTree, err := s.getTree(srcObjId)
+	if err != nil {
+		return err
+	}
+	dstTree, err := s.getTree(dstObjId)
+	if err != nil {
+		return err
+	}
 	var objIdToBeMoved OpId
 	var srcOps []*Operation
 	var scalarValue any
@@ -385,15 +619,45 @@ func (s *OpSet) Visualize() string {
 }
 
 func (s *OpSet) MoveObject(src OpId, dst OpId) error {
+	if src == RootOpId {
+		return errors.InvalidOperationError{Reason: "cannot move the root object"}
+	}
 	parent, property, err := s.moveManager.getParentAndProperty(src)
-	if property == nil {
-		panic(src.String() + ": property is nil")
-	} else if err != nil {
-		return err
+	if err != nil || property == nil {
+		// the object is deleted or was never created
+		return errors.ObjectNotFoundError{ObjId: src.String()}
 	}
 	return s.GenericMove(parent, dst, property, property)
 }
 
+// Location returns the parent of a present object, together with the property or the current list
+// index it has in its parent
+func (s *OpSet) Location(objId OpId) (OpId, any, error) {
+	parent, property, err := s.moveManager.getParentAndProperty(objId)
+	if err != nil {
+		return NullOpId, nil, err
+	}
+	tree, err := s.getTree(parent)
+	if err != nil {
+		return NullOpId, nil, err
+	}
+	if tree.Type == MAP {
+		return parent, property, nil
+	}
+	if index, ok := tree.indexOfObject(objId); ok {
+		return parent, index, nil
+	}
+	return NullOpId, nil, errors.ObjectNotFoundError{ObjId: objId.String()}
+}
+
 func (s *OpSet) BulkUpdateValidity(operations []*Operation) {
 	s.moveManager.BulkUpdateValidity(operations)
 }
+
+func (s *OpSet) TruncateMoveLog(stable map[uint]uint64) {
+	s.moveManager.Truncate(stable)
+}
+
+func (s *OpSet) MoveLogStats() MoveLogStats {
+	return s.moveManager.Stats()
+}
@@ -1,7 +1,7 @@
 package opset
 
 import (
-	"container/list"
+	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
 )
@@ -16,6 +16,7 @@ type ObjType uint8
 const (
 	LIST ObjType = iota
 	MAP
+	TEXT // a list of characters, see text.go
 )
 
 func (ot ObjType) String() string {
@@ -24,48 +25,54 @@ func (ot ObjType) String() string {
 		return "LIST"
 	case MAP:
 		return "MAP"
+	case TEXT:
+		return "TEXT"
 	default:
 		return ""
 	}
 }
 
+// ObjTypeOf returns the object type carried by the value of a MAKE operation.
+// Local operations hold an ObjType, while operations decoded from JSON hold a number.
+func ObjTypeOf(value any) ObjType {
+	switch v := value.(type) {
+	case ObjType:
+		return v
+	case float64:
+		return ObjType(v)
+	case json.Number:
+		objType, _ := v.Int64()
+		return ObjType(objType)
+	default:
+		panic(fmt.Sprintf("%v is not an object type", value))
+	}
+}
+
 type OpTree struct {
-	operations   *list.List
+	operations   *opSequence
 	lamportClock *OpId
 	Type         ObjType
 	ObjId        OpId
 	actorId      uuid.UUID
 	ops          *OpSet
+	marks        []*Operation // MARK operations of a text, kept apart from its elements
 }
 
 func NewOpTree(actorId uuid.UUID, lamportClock *OpId, objType ObjType, ObjId OpId, ops *OpSet) *OpTree {
-	return &OpTree{
+	tree := &OpTree{
 		actorId:      actorId,
-		operations:   list.New(),
 		lamportClock: lamportClock,
 		Type:         objType,
 		ObjId:        ObjId,
 		ops:          ops,
 	}
+	tree.operations = newOpSequence(tree)
+	return tree
 }
 
 func (opt *OpTree) insertOpWithValidityUpdate(op *Operation, index int, update bool) {
-
-	var elementAtIndex *list.Element
-	if index < opt.operations.Len() {
-		elementAtIndex = opt.operations.Front()
-		for i := 0; i < index; i++ {
-			elementAtIndex = elementAtIndex.Next()
-		}
-	} else {
-		elementAtIndex = nil
-	}
-
-	if elementAtIndex != nil {
-		opt.operations.InsertBefore(op, elementAtIndex)
-	} else {
-		opt.operations.PushBack(op)
-	}
+	opt.operations.InsertAt(index, op)
+	opt.ops.operations[op.OpId.Id] = op
 
 	if MoveEnabled && update {
 		opt.ops.moveManager.UpdateValidity(op)
@@ -0,0 +1,553 @@
+package opset
+
+import (
+	"reflect"
+	"sort"
+)
+
+type PatchAction uint8
+
+const (
+	PatchPut PatchAction = iota
+	PatchDelete
+	PatchInsert
+	PatchSplice
+	PatchMove
+	PatchConflict
+)
+
+func (action PatchAction) String() string {
+	switch action {
+	case PatchPut:
+		return "put"
+	case PatchDelete:
+		return "delete"
+	case PatchInsert:
+		return "insert"
+	case PatchSplice:
+		return "splice"
+	case PatchMove:
+		return "move"
+	case PatchConflict:
+		return "conflict"
+	}
+	return ""
+}
+
+// Patch describes a change of the visible state of one object. Applying a list of patches in order
+// turns the state before the change into the state after it.
+type Patch struct {
+	Action PatchAction
+	Obj    ExOpId // object that changed, or the moved object of PatchMove
+	Key    any    // property of a map, or index of a list or text (counted in the text encoding)
+
+	Value  any    // PatchPut: the new value, an ExOpId for objects
+	Values []any  // PatchInsert: the inserted values; PatchConflict: the concurrent values, winner last
+	Text   string // PatchSplice: the inserted text
+	Length int    // PatchDelete: the number of deleted elements, or characters of a text
+
+	// PatchMove: the object is removed from OldParent and put at NewKey of NewParent, where it
+	// overwrites the value of a map property or is inserted into a list
+	OldParent ExOpId
+	OldKey    any
+	NewParent ExOpId
+	NewKey    any
+}
+
+// Observer records the operations whose visibility changes while it is attached to an OpSet, which
+// happens when operations are inserted or removed and when moves become valid or invalid. Patches
+// are computed from these transitions only.
+type Observer struct {
+	s   *OpSet
+	was map[*Operation]bool // visibility of the operations that changed, as it was last reported
+}
+
+func (s *OpSet) NewObserver() *Observer {
+	s.observer = &Observer{s: s, was: map[*Operation]bool{}}
+	return s.observer
+}
+
+// changed is called by the opSequence when the visibility of an operation changed
+func (o *Observer) changed(op *Operation, was bool) {
+	if _, ok := o.was[op]; !ok {
+		o.was[op] = was
+	}
+}
+
+// Patches returns the patches caused by operations that were just applied, which includes the moves
+// whose validity changed meanwhile
+func (o *Observer) Patches(operations []*Operation) []Patch {
+	// the groups of the operations that changed visibility, and of counters that were incremented
+	groups := map[*Operation][]*Operation{}
+	incremented := map[*Operation]bool{}
+	increments := map[OpId]bool{}
+	for op := range o.was {
+		if op.leaf != nil {
+			head := op.leaf.seq.head(op)
+			groups[head] = append(groups[head], op)
+		}
+	}
+	for _, op := range operations {
+		if op.Action != INCREMENT {
+			continue
+		}
+		increments[op.OpId.Id] = true
+		for _, pred := range op.Pred {
+			if counter := o.s.findOperation(op.ObjId, pred); counter != nil && counter.leaf != nil {
+				head := counter.leaf.seq.head(counter)
+				groups[head] = append(groups[head], counter)
+				incremented[head] = true
+			}
+		}
+	}
+
+	slots := make([]*slot, 0, len(groups))
+	for head, changed := range groups {
+		var before *Operation
+		for _, op := range append(append([]*Operation{}, head.groupOps...), changed...) {
+			visible, ok := o.was[op]
+			if !ok {
+				visible = op.visible
+			}
+			if visible && (before == nil || op.OpId.Id.GreaterThan(o.s, &before.OpId.Id)) {
+				before = op
+			}
+		}
+		after := head.groupOps
+		if !incremented[head] && len(after) <= 1 && (len(after) == 0 && before == nil || len(after) == 1 && before == after[0]) {
+			continue
+		}
+		sl := o.s.newSlot(head, after)
+		if before != nil {
+			value, isObject := before.valueWithout(increments)
+			sl.before = &slotValue{op: before.OpId.Id, value: value, isObject: isObject}
+		}
+		slots = append(slots, sl)
+	}
+	o.was = map[*Operation]bool{}
+	return newPatchBuilder(o.s).build(slots)
+}
+
+// newSlot describes a group of an OpSet whose visible operations are after now
+func (s *OpSet) newSlot(head *Operation, after []*Operation) *slot {
+	tree := s.opTrees[head.ObjId]
+	sl := &slot{objId: head.ObjId, objType: tree.Type, key: head.Prop}
+	if tree.Type != MAP {
+		sl.key = head.OpId.Id
+		sl.pos = tree.operations.Position(head)
+		sl.index = tree.operations.VisibleBefore(head)
+		sl.units = tree.operations.UnitsBefore(head, s.textEncoding)
+	}
+	for _, op := range after {
+		sl.after = append(sl.after, *newSlotValue(op))
+	}
+	return sl
+}
+
+// Diff returns the patches that turn the visible state of before into the one of after. The union
+// contains the operations of both and gives the order of list elements. All three OpSets must have
+// the same actor table, so that their OpIds can be compared.
+func Diff(before *OpSet, after *OpSet, union *OpSet) []Patch {
+	slots := make([]*slot, 0)
+	visibleOps := func(s *OpSet, tree *OpTree, key any) []*Operation {
+		if tree == nil {
+			return nil
+		}
+		if property, ok := key.(string); ok {
+			operations, _ := tree.search(property)
+			return operations
+		}
+		if head := s.findOperation(tree.ObjId, key.(OpId)); head != nil && head.leaf != nil {
+			return head.groupOps
+		}
+		return nil
+	}
+	for objId, tree := range union.opTrees {
+		treeBefore, treeAfter := before.opTrees[objId], after.opTrees[objId]
+		if treeAfter == nil {
+			// created only by the changes that after doesn't have
+			continue
+		}
+		compare := func(key any, pos int, index int, units int) {
+			sl := &slot{objId: objId, objType: tree.Type, key: key, pos: pos, index: index, units: units}
+			for _, op := range visibleOps(after, treeAfter, key) {
+				sl.after = append(sl.after, *newSlotValue(op))
+			}
+			var previous []slotValue
+			for _, op := range visibleOps(before, treeBefore, key) {
+				previous = append(previous, *newSlotValue(op))
+			}
+			if len(previous) > 0 {
+				sl.before = &previous[len(previous)-1]
+			}
+			if !reflect.DeepEqual(previous, sl.after) {
+				slots = append(slots, sl)
+			}
+		}
+		if tree.Type == MAP {
+			keys := map[string]bool{}
+			for _, t := range []*OpTree{treeBefore, treeAfter} {
+				if t != nil {
+					for _, key := range t.MapKeys() {
+						keys[key] = true
+					}
+				}
+			}
+			sorted := make([]string, 0, len(keys))
+			for key := range keys {
+				sorted = append(sorted, key)
+			}
+			sort.Strings(sorted)
+			for _, key := range sorted {
+				compare(key, 0, 0, 0)
+			}
+			continue
+		}
+		// all elements are in the union, in the order both OpSets agree on
+		pos, index, units := 0, 0, 0
+		for element := tree.operations.Front(); element != nil; element = element.Next() {
+			if op := element.Value.(*Operation); op.Insert {
+				compare(op.OpId.Id, pos, index, units)
+				if visible := visibleOps(after, treeAfter, op.OpId.Id); len(visible) > 0 {
+					value, _ := visible[len(visible)-1].visibleValue()
+					index, units = index+1, units+after.textEncoding.width(value)
+				}
+			}
+			pos++
+		}
+	}
+	return newPatchBuilder(after).build(slots)
+}
+
+// slot is a map property or a list element whose value changed
+type slot struct {
+	objId   OpId
+	objType ObjType
+	key     any // property, or element id
+	pos     int // list elements: position in the op storage, which orders them
+	index   int // list elements: number of visible elements before the slot after the change
+	units   int // text elements: width of the visible elements before the slot after the change
+	before  *slotValue
+	after   []slotValue // visible values after the change, the winner last
+
+	moved   bool       // the value before or after is an object that was moved
+	current *slotValue // moved slots: the value in the patched state, which starts as before
+}
+
+type slotValue struct {
+	op       OpId // operation that put the value there
+	value    any  // OpId of an object, or a scalar value
+	isObject bool
+}
+
+func newSlotValue(op *Operation) *slotValue {
+	value, isObject := op.visibleValue()
+	return &slotValue{op: op.OpId.Id, value: value, isObject: isObject}
+}
+
+func (sl *slot) winner() *slotValue {
+	if len(sl.after) == 0 {
+		return nil
+	}
+	return &sl.after[len(sl.after)-1]
+}
+
+// holds returns the object a value stands for
+func (v *slotValue) holds() (OpId, bool) {
+	if v == nil || !v.isObject {
+		return NullOpId, false
+	}
+	return v.value.(OpId), true
+}
+
+// move is an object that left one slot and arrived in another
+type move struct {
+	objId OpId
+	from  *slot
+	to    *slot
+}
+
+type patchBuilder struct {
+	s       *OpSet // the OpSet after the change
+	objects map[OpId][]*slot
+	patches []Patch
+}
+
+func newPatchBuilder(s *OpSet) *patchBuilder {
+	return &patchBuilder{s: s, objects: map[OpId][]*slot{}, patches: make([]Patch, 0)}
+}
+
+// build turns changed slots into patches. Plain changes are reported first, while moved objects are
+// still where they were, then the moves, and then what is left at the slots the moves involved. The
+// position of a list element is its index after the change, corrected by the moved slots before it
+// whose patched value is not the final one yet.
+func (b *patchBuilder) build(slots []*slot) []Patch {
+	ids := make([]OpId, 0)
+	for _, sl := range slots {
+		// objects that are gone don't get patches, deleting them from their parent is enough
+		if !b.s.isPresent(sl.objId) {
+			continue
+		}
+		if _, ok := b.objects[sl.objId]; !ok {
+			ids = append(ids, sl.objId)
+		}
+		b.objects[sl.objId] = append(b.objects[sl.objId], sl)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[j].GreaterThan(b.s, &ids[i])
+	})
+	for _, objId := range ids {
+		objSlots := b.objects[objId]
+		sort.Slice(objSlots, func(i, j int) bool {
+			if property, ok := objSlots[i].key.(string); ok {
+				return property < objSlots[j].key.(string)
+			}
+			return objSlots[i].pos < objSlots[j].pos
+		})
+	}
+
+	moves := b.findMoves(ids)
+	for _, objId := range ids {
+		b.changes(objId)
+	}
+	for _, m := range moves {
+		b.move(m)
+	}
+	for _, objId := range ids {
+		b.remaining(objId)
+	}
+	for _, objId := range ids {
+		b.conflicts(objId)
+	}
+	return b.patches
+}
+
+// findMoves pairs the slots an object left with the slots it arrived in
+func (b *patchBuilder) findMoves(ids []OpId) []*move {
+	left := map[OpId]*slot{}
+	arrived := map[OpId]*slot{}
+	for _, objId := range ids {
+		for _, sl := range b.objects[objId] {
+			before, hadObject := sl.before.holds()
+			after, hasObject := sl.winner().holds()
+			if hadObject && (!hasObject || before != after) {
+				left[before] = sl
+			}
+			if hasObject && (!hadObject || before != after) {
+				arrived[after] = sl
+			}
+		}
+	}
+	moves := make([]*move, 0)
+	for objId, from := range left {
+		if to, ok := arrived[objId]; ok {
+			from.moved, to.moved = true, true
+			from.current, to.current = from.before, to.before
+			moves = append(moves, &move{objId: objId, from: from, to: to})
+		}
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		return moves[j].objId.GreaterThan(b.s, &moves[i].objId)
+	})
+	// an object is moved away before another one takes its place, where possible
+	ordered := make([]*move, 0, len(moves))
+	for len(moves) > 0 {
+		next := 0
+		for i, m := range moves {
+			blocked := false
+			for _, other := range moves {
+				if other != m && other.from == m.to {
+					blocked = true
+				}
+			}
+			if !blocked {
+				next = i
+				break
+			}
+		}
+		ordered = append(ordered, moves[next])
+		moves = append(moves[:next], moves[next+1:]...)
+	}
+	return ordered
+}
+
+func (b *patchBuilder) width(sl *slot, value *slotValue) int {
+	if value == nil {
+		return 0
+	}
+	if sl.objType == TEXT {
+		return b.s.textEncoding.width(value.value)
+	}
+	return 1
+}
+
+// key returns the property of a slot, or its position in the patched state
+func (b *patchBuilder) key(sl *slot) any {
+	if sl.objType == MAP {
+		return sl.key
+	}
+	index, units := sl.index, sl.units
+	for _, other := range b.objects[sl.objId] {
+		if other == sl {
+			break
+		}
+		if other.moved {
+			// the moved slot counts with its patched value instead of the final one
+			if other.current != nil {
+				index++
+				units += b.width(other, other.current)
+			}
+			if final := other.winner(); final != nil {
+				index--
+				units -= b.width(other, final)
+			}
+		}
+	}
+	if sl.objType == TEXT {
+		return units
+	}
+	return index
+}
+
+func (b *patchBuilder) exValue(value *slotValue) any {
+	return b.s.ToExValue(value.value)
+}
+
+// changes reports the slots of an object that are not involved in moves. Neighbouring deleted and
+// inserted list elements are reported together, deletions first.
+func (b *patchBuilder) changes(objId OpId) {
+	obj := *objId.ToExOpId(b.s)
+	var run []Patch // deletion and insertion of the current run of neighbouring list elements
+	var last *slot
+	flush := func() {
+		for _, patch := range run {
+			if patch.Length > 0 || len(patch.Values) > 0 || patch.Text != "" {
+				b.patches = append(b.patches, patch)
+			}
+		}
+		run, last = nil, nil
+	}
+	for _, sl := range b.objects[objId] {
+		if sl.moved {
+			flush()
+			continue
+		}
+		final := sl.winner()
+		replaced := sl.before != nil && final != nil && (sl.before.op != final.op || !reflect.DeepEqual(sl.before.value, final.value))
+		if sl.objType == MAP {
+			if final == nil && sl.before != nil {
+				b.patches = append(b.patches, Patch{Action: PatchDelete, Obj: obj, Key: sl.key})
+			} else if final != nil && (sl.before == nil || replaced) {
+				b.patches = append(b.patches, Patch{Action: PatchPut, Obj: obj, Key: sl.key, Value: b.exValue(final)})
+			}
+			continue
+		}
+		if sl.objType == LIST && replaced {
+			flush()
+			b.patches = append(b.patches, Patch{Action: PatchPut, Obj: obj, Key: b.key(sl), Value: b.exValue(final)})
+			continue
+		}
+		deleted := sl.before != nil && (final == nil || replaced)
+		inserted := final != nil && (sl.before == nil || replaced)
+		if !deleted && !inserted {
+			flush()
+			continue
+		}
+		// no element that stays lies between the slot and the last one of the run
+		if last == nil || last.winner() == nil && sl.index != last.index || last.winner() != nil && sl.index != last.index+1 {
+			flush()
+			key := b.key(sl)
+			run = []Patch{{Action: PatchDelete, Obj: obj, Key: key}, {Action: PatchInsert, Obj: obj, Key: key}}
+			if sl.objType == TEXT {
+				run[1].Action = PatchSplice
+			}
+		}
+		if deleted {
+			run[0].Length += b.width(sl, sl.before)
+		}
+		if inserted && sl.objType == TEXT {
+			run[1].Text += textOf(final.value)
+		} else if inserted {
+			run[1].Values = append(run[1].Values, b.exValue(final))
+		}
+		last = sl
+	}
+	flush()
+}
+
+// move reports a moved object and updates the patched values of the slots it left and arrived in
+func (b *patchBuilder) move(m *move) {
+	obj, from, to := *m.objId.ToExOpId(b.s), *m.from.objId.ToExOpId(b.s), *m.to.objId.ToExOpId(b.s)
+	replaced := m.to.objType != MAP && m.to.current != nil
+	if replaced {
+		// a list element that the object takes the place of goes first, the move inserts it
+		b.patches = append(b.patches, Patch{Action: PatchDelete, Obj: to, Key: b.key(m.to), Length: b.width(m.to, m.to.current)})
+		m.to.current = nil
+	}
+	patch := Patch{Action: PatchMove, Obj: obj, OldParent: from, OldKey: b.key(m.from), NewParent: to}
+	m.from.current = nil
+	patch.NewKey = b.key(m.to)
+	m.to.current = m.to.winner()
+	if !replaced && m.from.objId == m.to.objId && m.to.objType != MAP && patch.OldKey == patch.NewKey {
+		// moved to the same index of the same list, which is no visible change
+		return
+	}
+	b.patches = append(b.patches, patch)
+}
+
+// remaining reports the final values of the moved slots that are not there yet, like a value that
+// was written where an object moved away from
+func (b *patchBuilder) remaining(objId OpId) {
+	obj := *objId.ToExOpId(b.s)
+	for _, sl := range b.objects[objId] {
+		final := sl.winner()
+		if !sl.moved || reflect.DeepEqual(sl.current, final) {
+			continue
+		}
+		key := b.key(sl)
+		switch {
+		case final == nil:
+			length := 1
+			if sl.objType == TEXT {
+				length = b.width(sl, sl.current)
+			}
+			b.patches = append(b.patches, Patch{Action: PatchDelete, Obj: obj, Key: key, Length: length})
+		case sl.objType == MAP:
+			b.patches = append(b.patches, Patch{Action: PatchPut, Obj: obj, Key: key, Value: b.exValue(final)})
+		case sl.current != nil && sl.objType == LIST:
+			b.patches = append(b.patches, Patch{Action: PatchPut, Obj: obj, Key: key, Value: b.exValue(final)})
+		default:
+			if sl.current != nil {
+				b.patches = append(b.patches, Patch{Action: PatchDelete, Obj: obj, Key: key, Length: b.width(sl, sl.current)})
+			}
+			if sl.objType == TEXT {
+				b.patches = append(b.patches, Patch{Action: PatchSplice, Obj: obj, Key: key, Text: textOf(final.value)})
+			} else {
+				b.patches = append(b.patches, Patch{Action: PatchInsert, Obj: obj, Key: key, Values: []any{b.exValue(final)}})
+			}
+		}
+		sl.current = final
+	}
+}
+
+// conflicts reports the slots that have several concurrently visible values after the change
+func (b *patchBuilder) conflicts(objId OpId) {
+	obj := *objId.ToExOpId(b.s)
+	for _, sl := range b.objects[objId] {
+		if len(sl.after) < 2 {
+			continue
+		}
+		values := make([]any, 0, len(sl.after))
+		for i := range sl.after {
+			values = append(values, b.exValue(&sl.after[i]))
+		}
+		b.patches = append(b.patches, Patch{Action: PatchConflict, Obj: obj, Key: b.key(sl), Values: values})
+	}
+}
+
+func textOf(value any) string {
+	if str, ok := value.(string); ok {
+		return str
+	}
+	return objectReplacement
+}
@@ -0,0 +1,108 @@
+package opset
+
+import (
+	"fmt"
+	"github.com/LiangrunDa/AutomergeWithMove/errors"
+	"strconv"
+	"strings"
+)
+
+// ToPath converts a path given as a string like "students/0/name" or as a []any of properties and
+// indexes into a []any. In strings, "~1" stands for "/" and "~0" for "~" inside a segment. The empty
+// string is the root and a leading "/" is optional, as in a JSON Pointer, so that every other "/"
+// separates two segments and empty properties can be addressed: "/" is the property "" of the root.
+func ToPath(path any) ([]any, error) {
+	switch path := path.(type) {
+	case []any:
+		return path, nil
+	case []string:
+		segments := make([]any, 0, len(path))
+		for _, segment := range path {
+			segments = append(segments, segment)
+		}
+		return segments, nil
+	case string:
+		segments := make([]any, 0)
+		if path == "" {
+			return segments, nil
+		}
+		for _, segment := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+			segments = append(segments, strings.ReplaceAll(strings.ReplaceAll(segment, "~1", "/"), "~0", "~"))
+		}
+		return segments, nil
+	}
+	return nil, errors.InvalidOperationError{Reason: fmt.Sprintf("invalid path %v", path)}
+}
+
+// pathKey converts a segment of a path into a property of a map or an index of a list
+func (s *OpSet) pathKey(objId OpId, segment any) (any, error) {
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return nil, err
+	}
+	if tree.Type == MAP {
+		if property, ok := segment.(string); ok {
+			return property, nil
+		}
+		return nil, errors.InvalidOperationError{Reason: fmt.Sprintf("cannot use %v as a property", segment)}
+	}
+	switch segment := segment.(type) {
+	case int:
+		return segment, nil
+	case string:
+		if index, err := strconv.Atoi(segment); err == nil {
+			return index, nil
+		}
+	}
+	return nil, errors.InvalidOperationError{Reason: fmt.Sprintf("cannot use %v as an index", segment)}
+}
+
+// ResolvePath returns the parent object of the last segment of a path, and the last segment as a
+// property or index of it. Every other segment must lead to an object.
+func (s *OpSet) ResolvePath(path []any) (OpId, any, error) {
+	if len(path) == 0 {
+		return NullOpId, nil, errors.InvalidOperationError{Reason: "empty path"}
+	}
+	objId := RootOpId
+	for _, segment := range path[:len(path)-1] {
+		key, err := s.pathKey(objId, segment)
+		if err != nil {
+			return NullOpId, nil, err
+		}
+		value, err := s.Get(objId, key)
+		if err != nil {
+			return NullOpId, nil, err
+		}
+		switch child := value.(type) {
+		case *OpIdWithValid:
+			objId = child.Id
+		case OpId:
+			objId = child
+		default:
+			return NullOpId, nil, errors.InvalidOperationError{Reason: fmt.Sprintf("%v is not an object", segment)}
+		}
+	}
+	key, err := s.pathKey(objId, path[len(path)-1])
+	if err != nil {
+		return NullOpId, nil, err
+	}
+	return objId, key, nil
+}
+
+// PathOf returns the properties and current list indexes that lead from the root to an object. It
+// fails if the object is deleted.
+func (s *OpSet) PathOf(objId OpId) ([]any, error) {
+	if _, err := s.getTree(objId); err != nil {
+		return nil, err
+	}
+	path := make([]any, 0)
+	for objId != RootOpId {
+		parent, key, err := s.Location(objId)
+		if err != nil {
+			return nil, err
+		}
+		path = append([]any{key}, path...)
+		objId = parent
+	}
+	return path, nil
+}
@@ -0,0 +1,92 @@
+package opset
+
+// Rollback undoes local operations that were applied but not committed, newest first. The
+// operations must be the latest ones applied to the OpSet, which holds for the operations of the
+// current transaction, since their counters exceed those of all known operations.
+func (s *OpSet) Rollback(operations []*Operation, lamportClock uint64, lastOperation *Operation) {
+	for i := len(operations) - 1; i >= 0; i-- {
+		op := operations[i]
+		if op.Action == MARK {
+			s.opTrees[op.ObjId].removeMark(op)
+			continue
+		}
+		if MoveEnabled {
+			s.moveManager.rollback(op)
+		}
+		tree := s.opTrees[op.ObjId]
+		tree.removeOp(op)
+		s.removeSuccessor(op)
+		if op.Action == INCREMENT {
+			tree.removeIncrement(op)
+		}
+		if op.Action == MAKE {
+			delete(s.opTrees, op.OpId.Id)
+		}
+	}
+	s.lamportClock.Counter = lamportClock
+	s.lastOperation = lastOperation
+}
+
+func (opt *OpTree) removeOp(op *Operation) {
+	if op.leaf != nil {
+		opt.operations.Remove(op)
+	}
+	delete(opt.ops.operations, op.OpId.Id)
+}
+
+// removeSuccessor removes op from the successors of the operations it overwrote. Those are its
+// predecessors, in its own object or, for a move, in the object it moved from.
+func (s *OpSet) removeSuccessor(op *Operation) {
+	for _, pred := range op.Pred {
+		predOp, ok := s.operations[pred]
+		if !ok {
+			continue
+		}
+		for i, succ := range predOp.Succ {
+			if succ == op.OpId.Id {
+				predOp.Succ = append(predOp.Succ[:i], predOp.Succ[i+1:]...)
+				predOp.refreshVisibility()
+				break
+			}
+		}
+	}
+}
+
+// rollback undoes what UpdateValidity did for the latest applied operation
+func (m *MoveManager) rollback(operation *Operation) {
+	if operation.Action == MOVE {
+		logEntry := m.pop()
+		if logEntry.op != operation {
+			panic("rolled back operation is not the latest move")
+		}
+		m.revert(logEntry)
+		mid := *operation.MovedID
+		if winners, ok := m.winners[mid]; ok && winners.Len() == 0 {
+			delete(m.winners, mid)
+		}
+		delete(m.valid, operation.OpId.Id)
+		delete(m.moveIDMap, operation.OpId.Id)
+		delete(m.moveOps, operation.OpId.Id)
+		m.lifecycles[mid].remove(operation.OpId)
+	}
+	for _, pred := range operation.Pred {
+		if moveID, ok := m.moveIDMap[pred]; ok {
+			pred = moveID
+		}
+		if lst, ok := m.lifecycles[pred]; ok {
+			lst.remove(operation.OpId)
+		}
+	}
+	if operation.Action == MAKE || operation.Action == PUT {
+		delete(m.tree.parentMap, operation.OpId.Id)
+		delete(m.tree.propertyMap, operation.OpId.Id)
+		delete(m.lifecycles, operation.OpId.Id)
+	}
+}
+
+// remove deletes the event that happened at time, if there is one
+func (l *LifeCycleList) remove(time *OpIdWithValid) {
+	if index, found := l.find(time); found {
+		l.trackingEvents = append(l.trackingEvents[:index], l.trackingEvents[index+1:]...)
+	}
+}
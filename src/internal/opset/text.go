@@ -0,0 +1,137 @@
+package opset
+
+import (
+	"fmt"
+	"github.com/LiangrunDa/AutomergeWithMove/errors"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// A text object is a list whose elements are single characters, so it merges like a list. Positions
+// in text are counted in the units of the TextEncoding of the OpSet instead of in elements.
+
+type TextEncoding uint8
+
+const (
+	CodePoint TextEncoding = iota // positions count Unicode code points
+	UTF16                         // positions count UTF-16 code units, as in JavaScript strings
+)
+
+// objectReplacement stands for elements of a text that are not strings
+const objectReplacement = "\ufffc"
+
+func (s *OpSet) SetTextEncoding(encoding TextEncoding) {
+	s.textEncoding = encoding
+}
+
+func (s *OpSet) TextEncoding() TextEncoding {
+	return s.textEncoding
+}
+
+// width returns the number of units the value of a text element takes
+func (e TextEncoding) width(value any) int {
+	str, ok := value.(string)
+	if !ok {
+		return 1
+	}
+	if e == UTF16 {
+		return len(utf16.Encode([]rune(str)))
+	}
+	return utf8.RuneCountInString(str)
+}
+
+func (s *OpSet) getText(objId OpId) (*OpTree, error) {
+	tree, err := s.getTree(objId)
+	if err != nil {
+		return nil, err
+	}
+	if tree.Type != TEXT {
+		return nil, errors.InvalidOperationError{Reason: fmt.Sprintf("%v is not a text", objId)}
+	}
+	return tree, nil
+}
+
+// textValues returns the visible value of every element of a text
+func (opt *OpTree) textValues() []any {
+	values := make([]any, 0)
+	for _, operations := range opt.listElements() {
+		value, _ := operations[len(operations)-1].visibleValue()
+		values = append(values, value)
+	}
+	return values
+}
+
+func (opt *OpTree) text() string {
+	var builder strings.Builder
+	for _, value := range opt.textValues() {
+		if str, ok := value.(string); ok {
+			builder.WriteString(str)
+		} else {
+			builder.WriteString(objectReplacement)
+		}
+	}
+	return builder.String()
+}
+
+func (opt *OpTree) textLength() int {
+	return opt.operations.Units(opt.ops.textEncoding)
+}
+
+// Text returns the content of a text object as a string
+func (s *OpSet) Text(objId OpId) (string, error) {
+	tree, err := s.getText(objId)
+	if err != nil {
+		return "", err
+	}
+	return tree.text(), nil
+}
+
+// TextIndex converts a position in a text object to the index of the element starting there
+func (s *OpSet) TextIndex(objId OpId, pos int) (int, error) {
+	tree, err := s.getText(objId)
+	if err != nil {
+		return 0, err
+	}
+	if pos < 0 {
+		return 0, errors.ListIndexExceedsLengthError{Index: pos}
+	}
+	if pos > tree.textLength() {
+		return 0, errors.ListIndexExceedsLengthError{Index: pos}
+	}
+	index, start := tree.operations.AtUnits(pos, s.textEncoding)
+	if start != pos {
+		return 0, errors.InvalidOperationError{Reason: fmt.Sprintf("position %d is inside a character", pos)}
+	}
+	return index, nil
+}
+
+// Splice deletes del characters at pos of a text object and inserts text there, and returns the new
+// operations. The position is only resolved once, the characters are inserted one after another.
+func (s *OpSet) Splice(objId OpId, pos int, del int, text string) ([]*Operation, error) {
+	tree, err := s.getText(objId)
+	if err != nil {
+		return nil, err
+	}
+	start, err := s.TextIndex(objId, pos)
+	if err != nil {
+		return nil, err
+	}
+	end, err := s.TextIndex(objId, pos+del)
+	if err != nil {
+		return nil, err
+	}
+	operations := make([]*Operation, 0, end-start+len(text))
+	for i := start; i < end; i++ {
+		if err := tree.ListDelete(start); err != nil {
+			return operations, err
+		}
+		operations = append(operations, s.lastOperation)
+	}
+	chars := make([]any, 0, len(text))
+	for _, char := range text {
+		chars = append(chars, string(char))
+	}
+	inserted, err := tree.listInsertAll(start, chars)
+	return append(operations, inserted...), err
+}
@@ -0,0 +1,127 @@
+package opset
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/LiangrunDa/AutomergeWithMove/errors"
+	"strconv"
+	"time"
+)
+
+// Scalar values are stored as one of nil, bool, string, int64, uint64, float64, []byte, time.Time
+// and Counter, so that every replica reads back exactly the value that was put. Timestamps are kept
+// in UTC with millisecond precision. In JSON, ExOperation.Datatype names the types that JSON can't
+// tell apart.
+
+// NormalizeScalar converts a value to the type it is stored as
+func NormalizeScalar(value any) (any, error) {
+	switch v := value.(type) {
+	case nil, bool, string, int64, uint64, float64, Counter:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case uint:
+		return uint64(v), nil
+	case uint8:
+		return uint64(v), nil
+	case uint16:
+		return uint64(v), nil
+	case uint32:
+		return uint64(v), nil
+	case float32:
+		return float64(v), nil
+	case []byte:
+		return append([]byte{}, v...), nil
+	case time.Time:
+		return time.UnixMilli(v.UnixMilli()).UTC(), nil
+	default:
+		return nil, errors.InvalidOperationError{Reason: fmt.Sprintf("unsupported value type %T", value)}
+	}
+}
+
+func datatypeOf(value any) string {
+	switch value.(type) {
+	case int64:
+		return "int"
+	case uint64:
+		return "uint"
+	case []byte:
+		return "bytes"
+	case time.Time:
+		return "timestamp"
+	case Counter:
+		return "counter"
+	default:
+		return ""
+	}
+}
+
+// decodeValue restores the type of a value decoded from JSON with numbers as json.Number
+func decodeValue(value any, datatype string) any {
+	switch datatype {
+	case "int":
+		return toInt64(value)
+	case "uint":
+		return toUint64(value)
+	case "counter":
+		return Counter(toInt64(value))
+	case "bytes":
+		if str, ok := value.(string); ok {
+			bytes, _ := base64.StdEncoding.DecodeString(str)
+			return bytes
+		}
+	case "timestamp":
+		if str, ok := value.(string); ok {
+			timestamp, _ := time.Parse(time.RFC3339Nano, str)
+			return timestamp.UTC()
+		}
+	default:
+		if number, ok := value.(json.Number); ok {
+			float, _ := number.Float64()
+			return float
+		}
+	}
+	return value
+}
+
+// toInt64 converts a number decoded from JSON or from the binary encoding to int64
+func toInt64(value any) int64 {
+	switch v := value.(type) {
+	case int64:
+		return v
+	case Counter:
+		return int64(v)
+	case json.Number:
+		n, _ := v.Int64()
+		return n
+	case float64:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	default:
+		return 0
+	}
+}
+
+func toUint64(value any) uint64 {
+	switch v := value.(type) {
+	case uint64:
+		return v
+	case json.Number:
+		n, _ := strconv.ParseUint(v.String(), 10, 64)
+		return n
+	case float64:
+		return uint64(v)
+	case int64:
+		return uint64(v)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,111 @@
+package syncmsg
+
+import (
+	"encoding/binary"
+	"github.com/LiangrunDa/AutomergeWithMove/errors"
+	"github.com/LiangrunDa/AutomergeWithMove/internal/transaction"
+)
+
+const bitsPerEntry = 10
+const numProbes = 7
+
+// BloomFilter summarizes a set of change hashes. It may report false positives, but never false
+// negatives, so a peer only skips changes it is likely to have already.
+type BloomFilter struct {
+	numEntries   uint32
+	bitsPerEntry uint32
+	numProbes    uint32
+	bits         []byte
+}
+
+func NewBloomFilter(hashes []transaction.ChangeHash) *BloomFilter {
+	filter := &BloomFilter{
+		numEntries:   uint32(len(hashes)),
+		bitsPerEntry: bitsPerEntry,
+		numProbes:    numProbes,
+		bits:         make([]byte, (len(hashes)*bitsPerEntry+7)/8),
+	}
+	for _, hash := range hashes {
+		filter.addHash(hash)
+	}
+	return filter
+}
+
+// getProbes derives the bit positions of a hash by double hashing, using the first 12 bytes of the
+// (already uniformly distributed) hash as three 32-bit integers
+func (f *BloomFilter) getProbes(hash transaction.ChangeHash) []uint32 {
+	modulo := uint32(8 * len(f.bits))
+	x := binary.LittleEndian.Uint32(hash[0:4]) % modulo
+	y := binary.LittleEndian.Uint32(hash[4:8]) % modulo
+	z := binary.LittleEndian.Uint32(hash[8:12]) % modulo
+	probes := []uint32{x}
+	for i := uint32(1); i < f.numProbes; i++ {
+		x = (x + y) % modulo
+		y = (y + z) % modulo
+		probes = append(probes, x)
+	}
+	return probes
+}
+
+func (f *BloomFilter) addHash(hash transaction.ChangeHash) {
+	for _, probe := range f.getProbes(hash) {
+		f.bits[probe>>3] |= 1 << (probe & 7)
+	}
+}
+
+func (f *BloomFilter) ContainsHash(hash transaction.ChangeHash) bool {
+	if f.numEntries == 0 {
+		return false
+	}
+	for _, probe := range f.getProbes(hash) {
+		if f.bits[probe>>3]&(1<<(probe&7)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Bytes encodes the filter; an empty filter is encoded as no bytes at all
+func (f *BloomFilter) Bytes() []byte {
+	if f.numEntries == 0 {
+		return []byte{}
+	}
+	w := &writer{}
+	w.writeUvarint(uint64(f.numEntries))
+	w.writeUvarint(uint64(f.bitsPerEntry))
+	w.writeUvarint(uint64(f.numProbes))
+	w.buf.Write(f.bits)
+	return w.buf.Bytes()
+}
+
+func DecodeBloomFilter(bytes []byte) (*BloomFilter, error) {
+	if len(bytes) == 0 {
+		return NewBloomFilter(nil), nil
+	}
+	r := &reader{data: bytes}
+	numEntries, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	bitsPerEntry, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	numProbes, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if numEntries == 0 || bitsPerEntry == 0 || numProbes == 0 || numProbes > 64 || bitsPerEntry > 64 || numEntries > uint64(len(bytes)) {
+		return nil, errors.DecodeError{Reason: "invalid bloom filter parameters"}
+	}
+	bits, err := r.readBytes(int((numEntries*bitsPerEntry + 7) / 8))
+	if err != nil {
+		return nil, err
+	}
+	return &BloomFilter{
+		numEntries:   uint32(numEntries),
+		bitsPerEntry: uint32(bitsPerEntry),
+		numProbes:    uint32(numProbes),
+		bits:         append([]byte{}, bits...),
+	}, nil
+}
@@ -0,0 +1,191 @@
+package syncmsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/LiangrunDa/AutomergeWithMove/errors"
+	"github.com/LiangrunDa/AutomergeWithMove/internal/transaction"
+)
+
+const messageType = 0x42
+const stateType = 0x43
+
+// Have tells the other peer which changes we have: everything in the causal past of LastSync, plus
+// the changes summarized in Bloom
+type Have struct {
+	LastSync []transaction.ChangeHash
+	Bloom    []byte
+}
+
+type Message struct {
+	Heads   []transaction.ChangeHash
+	Need    []transaction.ChangeHash
+	Have    []Have
+	Changes []byte // changes encoded by transaction.EncodeChanges, empty if there are none
+}
+
+func (m *Message) Encode() []byte {
+	w := &writer{}
+	w.buf.WriteByte(messageType)
+	w.writeHashes(m.Heads)
+	w.writeHashes(m.Need)
+	w.writeUvarint(uint64(len(m.Have)))
+	for _, have := range m.Have {
+		w.writeHashes(have.LastSync)
+		w.writeBytes(have.Bloom)
+	}
+	w.writeBytes(m.Changes)
+	return w.buf.Bytes()
+}
+
+func DecodeMessage(data []byte) (*Message, error) {
+	r := &reader{data: data}
+	if typ, err := r.readByte(); err != nil || typ != messageType {
+		return nil, errors.DecodeError{Reason: "not a sync message"}
+	}
+	m := &Message{Have: make([]Have, 0)}
+	var err error
+	if m.Heads, err = r.readHashes(); err != nil {
+		return nil, err
+	}
+	if m.Need, err = r.readHashes(); err != nil {
+		return nil, err
+	}
+	numHave, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < numHave; i++ {
+		var have Have
+		if have.LastSync, err = r.readHashes(); err != nil {
+			return nil, err
+		}
+		if have.Bloom, err = r.readBytesWithLen(); err != nil {
+			return nil, err
+		}
+		m.Have = append(m.Have, have)
+	}
+	if m.Changes, err = r.readBytesWithLen(); err != nil {
+		return nil, err
+	}
+	return m, r.finish()
+}
+
+// EncodeState encodes the part of a sync state that survives a reconnect
+func EncodeState(sharedHeads []transaction.ChangeHash) []byte {
+	w := &writer{}
+	w.buf.WriteByte(stateType)
+	w.writeHashes(sharedHeads)
+	return w.buf.Bytes()
+}
+
+func DecodeState(data []byte) ([]transaction.ChangeHash, error) {
+	r := &reader{data: data}
+	if typ, err := r.readByte(); err != nil || typ != stateType {
+		return nil, errors.DecodeError{Reason: "not a sync state"}
+	}
+	sharedHeads, err := r.readHashes()
+	if err != nil {
+		return nil, err
+	}
+	return sharedHeads, r.finish()
+}
+
+type writer struct {
+	buf bytes.Buffer
+}
+
+func (w *writer) writeUvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	w.buf.Write(tmp[:n])
+}
+
+func (w *writer) writeBytes(b []byte) {
+	w.writeUvarint(uint64(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *writer) writeHashes(hashes []transaction.ChangeHash) {
+	w.writeUvarint(uint64(len(hashes)))
+	for _, hash := range hashes {
+		w.buf.Write(hash[:])
+	}
+}
+
+type reader struct {
+	data []byte
+	pos  int
+}
+
+func (r *reader) readUvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, errors.DecodeError{Reason: "malformed varint"}
+	}
+	r.pos += n
+	return v, nil
+}
+
+// readLen reads a length and checks that it doesn't exceed the remaining input
+func (r *reader) readLen() (int, error) {
+	v, err := r.readUvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > uint64(len(r.data)-r.pos) {
+		return 0, errors.DecodeError{Reason: "length exceeds input"}
+	}
+	return int(v), nil
+}
+
+func (r *reader) readByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errors.DecodeError{Reason: "unexpected end of input"}
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *reader) readBytes(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data)-r.pos {
+		return nil, errors.DecodeError{Reason: "unexpected end of input"}
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *reader) readBytesWithLen() ([]byte, error) {
+	n, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	return r.readBytes(n)
+}
+
+func (r *reader) readHashes() ([]transaction.ChangeHash, error) {
+	n, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]transaction.ChangeHash, 0, n)
+	for i := 0; i < n; i++ {
+		raw, err := r.readBytes(len(transaction.ChangeHash{}))
+		if err != nil {
+			return nil, err
+		}
+		var hash transaction.ChangeHash
+		copy(hash[:], raw)
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+func (r *reader) finish() error {
+	if r.pos != len(r.data) {
+		return errors.DecodeError{Reason: "trailing bytes"}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package transaction
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/json"
 	"github.com/LiangrunDa/AutomergeWithMove/internal/opset"
@@ -62,6 +63,21 @@ func (c *Change) FromExChange(exChange ExChange, s *opset.OpSet) {
 	}
 }
 
+// Copy returns a copy of the change whose operations belong to another OpSet
+func (c *Change) Copy(from *opset.OpSet, to *opset.OpSet) *Change {
+	copied := &Change{
+		ActorId:      c.ActorId,
+		Seq:          c.Seq,
+		Dependencies: c.Dependencies,
+		StartOp:      c.StartOp,
+		HashCache:    c.HashCache,
+	}
+	for _, op := range c.Operations {
+		copied.Operations = append(copied.Operations, op.Copy(from, to))
+	}
+	return copied
+}
+
 func (c *Change) ToBytes(s *opset.OpSet) []byte {
 	exChange := c.ToExChange(s)
 	bytes, err := json.Marshal(exChange)
@@ -74,7 +90,7 @@ func (c *Change) ToBytes(s *opset.OpSet) []byte {
 
 func (c *Change) FromBytes(bytes []byte, s *opset.OpSet) error {
 	var exChange ExChange
-	err := json.Unmarshal(bytes, &exChange)
+	err := unmarshal(bytes, &exChange)
 	if err == nil {
 		c.FromExChange(exChange, s)
 		return nil
@@ -98,7 +114,7 @@ type ExChangeArray []*ExChange
 func NewChangeArrayFromBytes(bytes []byte, s *opset.OpSet) ChangeArray {
 	var exChanges ExChangeArray
 	var changes ChangeArray
-	err := json.Unmarshal(bytes, &exChanges)
+	err := unmarshal(bytes, &exChanges)
 	if err == nil {
 		for _, exChange := range exChanges {
 			var change Change
@@ -117,7 +133,7 @@ func NewChangeArrayFromBytes(bytes []byte, s *opset.OpSet) ChangeArray {
 func NewChangeFromBytes(bytes []byte, s *opset.OpSet) *Change {
 	var exChange ExChange
 	var change Change
-	err := json.Unmarshal(bytes, &exChange)
+	err := unmarshal(bytes, &exChange)
 	if err == nil {
 		for j := 0; j < len(exChange.Operations); j++ {
 			exChange.Operations[j].Convert()
@@ -128,3 +144,10 @@ func NewChangeFromBytes(bytes []byte, s *opset.OpSet) *Change {
 		return nil
 	}
 }
+
+// unmarshal decodes JSON with numbers as json.Number, so that integers are read back exactly
+func unmarshal(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
@@ -0,0 +1,670 @@
+package transaction
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/LiangrunDa/AutomergeWithMove/errors"
+	"github.com/LiangrunDa/AutomergeWithMove/internal/opset"
+	"github.com/google/uuid"
+	"math"
+	"time"
+)
+
+// Binary layout of an encoded change chunk:
+//
+//	magic | version | actor table | object table | property table | changes
+//
+// Actors, object ids and string properties are stored once in their tables and referenced by
+// index afterwards. All integers are varints. A dependency is either a reference to an earlier
+// change in the same chunk or a full hash of a change outside of it. Chunks can be concatenated,
+// which is how incremental saves are appended to a saved document.
+
+var chunkMagic = []byte{'A', 'M', 'W', 'M'}
+
+const chunkVersion = 1
+
+const (
+	flagInsert     = 1 << 4
+	flagMovedID    = 1 << 5
+	flagMoveSrc    = 1 << 6
+	flagOpIdProp   = 1 << 7
+	flagActionMask = 0x0f
+)
+
+const (
+	valueNull byte = iota
+	valueFalse
+	valueTrue
+	valueFloat64
+	valueString
+	valueInt64
+	valueUint64
+	valueObjType
+	valueOpId
+	valueJSON
+	valueCounter
+	valueBytes
+	valueTimestamp
+)
+
+type encoder struct {
+	buf       bytes.Buffer
+	s         *opset.OpSet
+	actors    []uuid.UUID
+	actorIdx  map[uint]int
+	objIds    []opset.OpId
+	objIdx    map[opset.OpId]int
+	props     []string
+	propIdx   map[string]int
+	changeIdx map[ChangeHash]int
+}
+
+// EncodeChanges encodes changes into a compact binary chunk. Changes must be causally ordered.
+func EncodeChanges(changes []*Change, s *opset.OpSet) []byte {
+	e := &encoder{
+		s:         s,
+		actorIdx:  map[uint]int{},
+		objIdx:    map[opset.OpId]int{},
+		propIdx:   map[string]int{},
+		changeIdx: map[ChangeHash]int{},
+	}
+	e.collectTables(changes)
+
+	e.buf.Write(chunkMagic)
+	e.buf.WriteByte(chunkVersion)
+	e.writeUvarint(uint64(len(e.actors)))
+	for _, actor := range e.actors {
+		e.buf.Write(actor[:])
+	}
+	e.writeUvarint(uint64(len(e.objIds)))
+	for _, objId := range e.objIds {
+		e.writeOpId(objId)
+	}
+	e.writeUvarint(uint64(len(e.props)))
+	for _, prop := range e.props {
+		e.writeString(prop)
+	}
+	e.writeUvarint(uint64(len(changes)))
+	for i, change := range changes {
+		e.writeChange(change)
+		e.changeIdx[change.Hash()] = i
+	}
+	return e.buf.Bytes()
+}
+
+func (e *encoder) collectTables(changes []*Change) {
+	for _, change := range changes {
+		e.addActor(e.s.GetIdx(change.ActorId))
+		for _, op := range change.Operations {
+			e.addActor(op.OpId.Id.ActorId)
+			e.addObjId(op.ObjId)
+			if prop, ok := op.Prop.(string); ok {
+				e.addProp(prop)
+			} else if prop, ok := op.Prop.(opset.OpId); ok {
+				e.addActor(prop.ActorId)
+			}
+			for _, pred := range op.Pred {
+				e.addActor(pred.ActorId)
+			}
+			if op.MovedID != nil {
+				e.addActor(op.MovedID.ActorId)
+			}
+			if op.MoveSrc != nil {
+				e.addObjId(*op.MoveSrc)
+			}
+			if value, ok := op.Value.(opset.OpId); ok {
+				e.addActor(value.ActorId)
+			}
+			if op.Mark != nil {
+				e.addActor(op.Mark.Start.Elem.ActorId)
+				e.addActor(op.Mark.End.Elem.ActorId)
+			}
+		}
+	}
+}
+
+func (e *encoder) addActor(actor uint) {
+	if _, ok := e.actorIdx[actor]; !ok {
+		e.actorIdx[actor] = len(e.actors)
+		e.actors = append(e.actors, e.s.GetActorId(actor))
+	}
+}
+
+func (e *encoder) addObjId(objId opset.OpId) {
+	e.addActor(objId.ActorId)
+	if _, ok := e.objIdx[objId]; !ok {
+		e.objIdx[objId] = len(e.objIds)
+		e.objIds = append(e.objIds, objId)
+	}
+}
+
+func (e *encoder) addProp(prop string) {
+	if _, ok := e.propIdx[prop]; !ok {
+		e.propIdx[prop] = len(e.props)
+		e.props = append(e.props, prop)
+	}
+}
+
+func (e *encoder) writeUvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	e.buf.Write(tmp[:n])
+}
+
+func (e *encoder) writeVarint(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	e.buf.Write(tmp[:n])
+}
+
+func (e *encoder) writeString(str string) {
+	e.writeUvarint(uint64(len(str)))
+	e.buf.WriteString(str)
+}
+
+func (e *encoder) writeOpId(opId opset.OpId) {
+	e.writeUvarint(uint64(e.actorIdx[opId.ActorId]))
+	e.writeUvarint(opId.Counter)
+}
+
+func (e *encoder) writeChange(change *Change) {
+	e.writeUvarint(uint64(e.actorIdx[e.s.GetIdx(change.ActorId)]))
+	e.writeUvarint(uint64(change.Seq))
+	e.writeUvarint(change.StartOp)
+	e.buf.Write(change.HashCache[:])
+	e.writeUvarint(uint64(len(change.Dependencies)))
+	for _, dep := range change.Dependencies {
+		if idx, ok := e.changeIdx[dep]; ok {
+			e.writeUvarint(uint64(idx) + 1)
+		} else {
+			e.writeUvarint(0)
+			e.buf.Write(dep[:])
+		}
+	}
+	e.writeUvarint(uint64(len(change.Operations)))
+	for _, op := range change.Operations {
+		e.writeOperation(op)
+	}
+}
+
+func (e *encoder) writeOperation(op *opset.Operation) {
+	flags := byte(op.Action) & flagActionMask
+	if op.Insert {
+		flags |= flagInsert
+	}
+	if op.MovedID != nil {
+		flags |= flagMovedID
+	}
+	if op.MoveSrc != nil {
+		flags |= flagMoveSrc
+	}
+	if _, ok := op.Prop.(opset.OpId); ok {
+		flags |= flagOpIdProp
+	}
+	e.buf.WriteByte(flags)
+	e.writeOpId(op.OpId.Id)
+	e.writeUvarint(uint64(e.objIdx[op.ObjId]))
+	if prop, ok := op.Prop.(opset.OpId); ok {
+		e.writeOpId(prop)
+	} else {
+		e.writeUvarint(uint64(e.propIdx[op.Prop.(string)]))
+	}
+	if op.Action == opset.MAKE {
+		e.buf.WriteByte(valueObjType)
+		e.buf.WriteByte(byte(opset.ObjTypeOf(op.Value)))
+	} else {
+		e.writeValue(op.Value)
+	}
+	e.writeUvarint(uint64(len(op.Pred)))
+	for _, pred := range op.Pred {
+		e.writeOpId(pred)
+	}
+	if op.MovedID != nil {
+		e.writeOpId(*op.MovedID)
+	}
+	if op.MoveSrc != nil {
+		e.writeUvarint(uint64(e.objIdx[*op.MoveSrc]))
+	}
+	if op.Action == opset.MARK {
+		e.writeMarkAnchor(op.Mark.Start)
+		e.writeMarkAnchor(op.Mark.End)
+	}
+}
+
+func (e *encoder) writeMarkAnchor(anchor opset.MarkAnchor) {
+	e.writeOpId(anchor.Elem)
+	if anchor.After {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *encoder) writeValue(value any) {
+	switch v := value.(type) {
+	case nil:
+		e.buf.WriteByte(valueNull)
+	case bool:
+		if v {
+			e.buf.WriteByte(valueTrue)
+		} else {
+			e.buf.WriteByte(valueFalse)
+		}
+	case float64:
+		e.buf.WriteByte(valueFloat64)
+		var tmp [8]byte
+		binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v))
+		e.buf.Write(tmp[:])
+	case string:
+		e.buf.WriteByte(valueString)
+		e.writeString(v)
+	case int64:
+		e.buf.WriteByte(valueInt64)
+		e.writeVarint(v)
+	case uint64:
+		e.buf.WriteByte(valueUint64)
+		e.writeUvarint(v)
+	case opset.OpId:
+		e.buf.WriteByte(valueOpId)
+		e.writeOpId(v)
+	case opset.Counter:
+		e.buf.WriteByte(valueCounter)
+		e.writeVarint(int64(v))
+	case []byte:
+		e.buf.WriteByte(valueBytes)
+		e.writeUvarint(uint64(len(v)))
+		e.buf.Write(v)
+	case time.Time:
+		e.buf.WriteByte(valueTimestamp)
+		e.writeVarint(v.UnixMilli())
+	default:
+		// values of other types fall back to the JSON representation used by ToBytes
+		e.buf.WriteByte(valueJSON)
+		bytes, _ := json.Marshal(v)
+		e.writeString(string(bytes))
+	}
+}
+
+type decoder struct {
+	data       []byte
+	pos        int
+	s          *opset.OpSet
+	actors     []uint
+	objIds     []opset.OpId
+	props      []string
+	changes    []*Change
+	chunkStart int // index of the first change of the current chunk
+}
+
+// DecodeChanges decodes one or more concatenated chunks produced by EncodeChanges, translating
+// actor ids into indexes of s. New actors are registered in s only if decoding succeeds.
+func DecodeChanges(data []byte, s *opset.OpSet) ([]*Change, error) {
+	d := &decoder{data: data, s: s}
+	if len(data) == 0 {
+		return nil, errors.DecodeError{Reason: "empty input"}
+	}
+	actors := s.ActorCount()
+	for d.pos < len(d.data) {
+		if err := d.readChunk(); err != nil {
+			// only successfully decoded changes register their actors
+			s.ForgetActors(actors)
+			return nil, err
+		}
+	}
+	return d.changes, nil
+}
+
+func (d *decoder) readChunk() error {
+	if len(d.data)-d.pos < len(chunkMagic)+1 || !bytes.Equal(d.data[d.pos:d.pos+len(chunkMagic)], chunkMagic) {
+		return errors.DecodeError{Reason: "not an encoded chunk"}
+	}
+	d.pos += len(chunkMagic)
+	if version := d.data[d.pos]; version != chunkVersion {
+		return errors.DecodeError{Reason: "unsupported version"}
+	}
+	d.pos++
+	d.actors = d.actors[:0]
+	d.objIds = d.objIds[:0]
+	d.props = d.props[:0]
+	d.chunkStart = len(d.changes)
+
+	numActors, err := d.readLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < numActors; i++ {
+		raw, err := d.readBytes(16)
+		if err != nil {
+			return err
+		}
+		actor, _ := uuid.FromBytes(raw)
+		d.actors = append(d.actors, d.s.GetIdx(actor))
+	}
+	numObjIds, err := d.readLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < numObjIds; i++ {
+		objId, err := d.readOpId()
+		if err != nil {
+			return err
+		}
+		d.objIds = append(d.objIds, objId)
+	}
+	numProps, err := d.readLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < numProps; i++ {
+		prop, err := d.readString()
+		if err != nil {
+			return err
+		}
+		d.props = append(d.props, prop)
+	}
+	numChanges, err := d.readLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < numChanges; i++ {
+		change, err := d.readChange()
+		if err != nil {
+			return err
+		}
+		d.changes = append(d.changes, change)
+	}
+	return nil
+}
+
+func (d *decoder) readUvarint() (uint64, error) {
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, errors.DecodeError{Reason: "malformed varint"}
+	}
+	d.pos += n
+	return v, nil
+}
+
+func (d *decoder) readVarint() (int64, error) {
+	v, n := binary.Varint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, errors.DecodeError{Reason: "malformed varint"}
+	}
+	d.pos += n
+	return v, nil
+}
+
+// readLen reads a length and checks that it doesn't exceed the remaining input
+func (d *decoder) readLen() (int, error) {
+	v, err := d.readUvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > uint64(len(d.data)-d.pos) {
+		return 0, errors.DecodeError{Reason: "length exceeds input"}
+	}
+	return int(v), nil
+}
+
+func (d *decoder) readByte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errors.DecodeError{Reason: "unexpected end of input"}
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *decoder) readBytes(n int) ([]byte, error) {
+	if d.pos+n > len(d.data) {
+		return nil, errors.DecodeError{Reason: "unexpected end of input"}
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) readString() (string, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return "", err
+	}
+	b, err := d.readBytes(n)
+	return string(b), err
+}
+
+func (d *decoder) readIndex(length int) (int, error) {
+	v, err := d.readUvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v >= uint64(length) {
+		return 0, errors.DecodeError{Reason: "table index out of range"}
+	}
+	return int(v), nil
+}
+
+func (d *decoder) readOpId() (opset.OpId, error) {
+	actor, err := d.readIndex(len(d.actors))
+	if err != nil {
+		return opset.OpId{}, err
+	}
+	counter, err := d.readUvarint()
+	if err != nil {
+		return opset.OpId{}, err
+	}
+	return opset.OpId{ActorId: d.actors[actor], Counter: counter}, nil
+}
+
+func (d *decoder) readObjId() (opset.OpId, error) {
+	idx, err := d.readIndex(len(d.objIds))
+	if err != nil {
+		return opset.OpId{}, err
+	}
+	return d.objIds[idx], nil
+}
+
+func (d *decoder) readChange() (*Change, error) {
+	actor, err := d.readIndex(len(d.actors))
+	if err != nil {
+		return nil, err
+	}
+	seq, err := d.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	startOp, err := d.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := d.readBytes(len(ChangeHash{}))
+	if err != nil {
+		return nil, err
+	}
+	change := &Change{
+		ActorId:      d.s.GetActorId(d.actors[actor]),
+		Seq:          uint32(seq),
+		StartOp:      startOp,
+		Dependencies: make([]ChangeHash, 0),
+	}
+	copy(change.HashCache[:], hash)
+
+	numDeps, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < numDeps; i++ {
+		ref, err := d.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if ref == 0 {
+			raw, err := d.readBytes(len(ChangeHash{}))
+			if err != nil {
+				return nil, err
+			}
+			var dep ChangeHash
+			copy(dep[:], raw)
+			change.Dependencies = append(change.Dependencies, dep)
+		} else if ref <= uint64(len(d.changes)-d.chunkStart) {
+			change.Dependencies = append(change.Dependencies, d.changes[d.chunkStart+int(ref)-1].Hash())
+		} else {
+			return nil, errors.DecodeError{Reason: "dependency refers to a later change"}
+		}
+	}
+
+	numOps, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < numOps; i++ {
+		op, err := d.readOperation()
+		if err != nil {
+			return nil, err
+		}
+		change.Operations = append(change.Operations, op)
+	}
+	return change, nil
+}
+
+func (d *decoder) readOperation() (*opset.Operation, error) {
+	flags, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	opId, err := d.readOpId()
+	if err != nil {
+		return nil, err
+	}
+	objId, err := d.readObjId()
+	if err != nil {
+		return nil, err
+	}
+	op := &opset.Operation{
+		OpId:   opset.NewOpIdWithValid(opId),
+		ObjId:  objId,
+		Action: opset.ActionType(flags & flagActionMask),
+		Pred:   make([]opset.OpId, 0),
+		Succ:   make([]opset.OpId, 0),
+		Insert: flags&flagInsert != 0,
+	}
+	if flags&flagOpIdProp != 0 {
+		if op.Prop, err = d.readOpId(); err != nil {
+			return nil, err
+		}
+	} else {
+		idx, err := d.readIndex(len(d.props))
+		if err != nil {
+			return nil, err
+		}
+		op.Prop = d.props[idx]
+	}
+	if op.Value, err = d.readValue(); err != nil {
+		return nil, err
+	}
+	numPred, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < numPred; i++ {
+		pred, err := d.readOpId()
+		if err != nil {
+			return nil, err
+		}
+		op.Pred = append(op.Pred, pred)
+	}
+	if flags&flagMovedID != 0 {
+		movedID, err := d.readOpId()
+		if err != nil {
+			return nil, err
+		}
+		op.MovedID = &movedID
+	}
+	if flags&flagMoveSrc != 0 {
+		moveSrc, err := d.readObjId()
+		if err != nil {
+			return nil, err
+		}
+		op.MoveSrc = &moveSrc
+	}
+	if op.Action == opset.MARK {
+		op.Mark = &opset.MarkRange{}
+		if op.Mark.Start, err = d.readMarkAnchor(); err != nil {
+			return nil, err
+		}
+		if op.Mark.End, err = d.readMarkAnchor(); err != nil {
+			return nil, err
+		}
+	}
+	return op, nil
+}
+
+func (d *decoder) readMarkAnchor() (opset.MarkAnchor, error) {
+	elem, err := d.readOpId()
+	if err != nil {
+		return opset.MarkAnchor{}, err
+	}
+	after, err := d.readByte()
+	if err != nil {
+		return opset.MarkAnchor{}, err
+	}
+	return opset.MarkAnchor{Elem: elem, After: after != 0}, nil
+}
+
+func (d *decoder) readValue() (any, error) {
+	tag, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case valueNull:
+		return nil, nil
+	case valueFalse:
+		return false, nil
+	case valueTrue:
+		return true, nil
+	case valueFloat64:
+		raw, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(raw)), nil
+	case valueString:
+		return d.readString()
+	case valueInt64:
+		return d.readVarint()
+	case valueUint64:
+		return d.readUvarint()
+	case valueObjType:
+		objType, err := d.readByte()
+		return opset.ObjType(objType), err
+	case valueOpId:
+		return d.readOpId()
+	case valueCounter:
+		counter, err := d.readVarint()
+		return opset.Counter(counter), err
+	case valueBytes:
+		length, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.readBytes(length)
+		return append([]byte{}, raw...), err
+	case valueTimestamp:
+		millis, err := d.readVarint()
+		return time.UnixMilli(millis).UTC(), err
+	case valueJSON:
+		raw, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		var value any
+		if err := json.Unmarshal([]byte(raw), &value); err != nil {
+			return nil, errors.DecodeError{Reason: err.Error()}
+		}
+		return value, nil
+	default:
+		return nil, errors.DecodeError{Reason: "unknown value tag"}
+	}
+}
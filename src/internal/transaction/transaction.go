@@ -2,6 +2,7 @@ package transaction
 
 import (
 	"fmt"
+	"github.com/LiangrunDa/AutomergeWithMove/errors"
 	"github.com/LiangrunDa/AutomergeWithMove/internal/log"
 	"github.com/LiangrunDa/AutomergeWithMove/internal/opset"
 	"github.com/google/uuid"
@@ -10,14 +11,23 @@ import (
 
 type Transaction interface {
 	Get(objId opset.ExOpId, propertyOrIndex any) (any, error)
-	Put(objId opset.ExOpId, propertyOrIndex any, value any)
+	GetAll(objId opset.ExOpId, propertyOrIndex any) ([]opset.ConflictValue, error)
+	Put(objId opset.ExOpId, propertyOrIndex any, value any) error
 	Delete(objId opset.ExOpId, propertyOrIndex any) error
 	PutObject(objId opset.ExOpId, property string, objType opset.ObjType) (opset.ExOpId, error)
-	Insert(objId opset.ExOpId, index int, value any)
+	Insert(objId opset.ExOpId, index int, value any) error
 	InsertObject(objId opset.ExOpId, index int, objType opset.ObjType) (opset.ExOpId, error)
+	Increment(objId opset.ExOpId, propertyOrIndex any, delta int64) error
+	Splice(objId opset.ExOpId, pos int, del int, text string) error
+	Mark(objId opset.ExOpId, start int, end int, name string, value any, expand opset.ExpandPolicy) error
+	Unmark(objId opset.ExOpId, start int, end int, name string, expand opset.ExpandPolicy) error
 	Move(srcObjId opset.ExOpId, dstObjId opset.ExOpId, srcPropertyOrIndex any, dstPropertyOrIndex any) error
 	Commit() (*Change, error)
+	Rollback()
 	MoveObject(srcObjId opset.ExOpId, dstObjId opset.ExOpId) error
+	Invert(change *Change) error
+	PutPath(path any, value any) error
+	PutObjectPath(path any, objType opset.ObjType) (opset.ExOpId, error)
 }
 
 type TransactionImpl struct {
@@ -27,16 +37,21 @@ type TransactionImpl struct {
 	pendingOperations []*opset.Operation
 	deps              []ChangeHash
 	startOpCounter    uint64
+	prevLamportClock  uint64           // clock before the transaction, restored on rollback
+	prevLastOperation *opset.Operation // last operation before the transaction, restored on rollback
 }
 
 func NewTransaction(actorId uuid.UUID, seq uint32, ops *opset.OpSet, startOpCounter uint64, deps []ChangeHash, analysisMode bool) Transaction {
+	prevLamportClock := ops.GetLamportClock().Counter
 	ops.UpdateLamportClock(startOpCounter)
 	txn := &TransactionImpl{
-		actorId:        actorId,
-		seq:            seq,
-		ops:            ops,
-		deps:           deps,
-		startOpCounter: startOpCounter,
+		actorId:           actorId,
+		seq:               seq,
+		ops:               ops,
+		deps:              deps,
+		startOpCounter:    startOpCounter,
+		prevLamportClock:  prevLamportClock,
+		prevLastOperation: ops.GetLastOperation(),
 	}
 	txnId := fmt.Sprintf("%d-%d", ops.GetIdx(actorId), seq)
 	logrus.SetFormatter(log.NewTransactionFormatter(txnId, analysisMode))
@@ -54,37 +69,27 @@ func (t *TransactionImpl) updatePendingOps() {
 	}
 }
 
-func covertToFloat64(value any) any {
-	switch value.(type) {
-	case int:
-		return float64(value.(int))
-	case int64:
-		return float64(value.(int64))
-	case float32:
-		return float64(value.(float32))
-	default:
-		return value
-	}
-}
-
 func (t *TransactionImpl) Get(objId opset.ExOpId, propertyOrIndex any) (any, error) {
 	id := objId.ToOpId(t.ops)
 	res, err := t.ops.Get(*id, propertyOrIndex)
-	if v, ok := res.(*opset.OpIdWithValid); ok {
-		return *v.Id.ToExOpId(t.ops), err
-	} else if v, ok := res.(opset.OpId); ok {
-		return *v.ToExOpId(t.ops), err
-	} else {
-		return res, err
-	}
+	return t.ops.ToExValue(res), err
+}
+
+func (t *TransactionImpl) GetAll(objId opset.ExOpId, propertyOrIndex any) ([]opset.ConflictValue, error) {
+	return t.ops.GetAll(*objId.ToOpId(t.ops), propertyOrIndex)
 }
 
-func (t *TransactionImpl) Put(objId opset.ExOpId, propertyOrIndex any, value any) {
+func (t *TransactionImpl) Put(objId opset.ExOpId, propertyOrIndex any, value any) error {
+	value, err := opset.NormalizeScalar(value)
+	if err != nil {
+		return err
+	}
 	id := objId.ToOpId(t.ops)
-	if err := t.ops.Put(*id, propertyOrIndex, covertToFloat64(value)); err == nil {
+	if err := t.ops.Put(*id, propertyOrIndex, value); err == nil {
 		t.updatePendingOps()
+		return nil
 	} else {
-		logrus.Error(err)
+		return err
 	}
 }
 
@@ -107,11 +112,16 @@ func (t *TransactionImpl) PutObject(objId opset.ExOpId, property string, objType
 	}
 }
 
-func (t *TransactionImpl) Insert(objId opset.ExOpId, index int, value any) {
-	if err := t.ops.Insert(*objId.ToOpId(t.ops), index, covertToFloat64(value)); err == nil {
+func (t *TransactionImpl) Insert(objId opset.ExOpId, index int, value any) error {
+	value, err := opset.NormalizeScalar(value)
+	if err != nil {
+		return err
+	}
+	if err := t.ops.Insert(*objId.ToOpId(t.ops), index, value); err == nil {
 		t.updatePendingOps()
+		return nil
 	} else {
-		logrus.Error(err)
+		return err
 	}
 }
 
@@ -124,6 +134,53 @@ func (t *TransactionImpl) InsertObject(objId opset.ExOpId, index int, objType op
 	}
 }
 
+// Increment adds delta to the counter at a property of a map or an element of a list
+func (t *TransactionImpl) Increment(objId opset.ExOpId, propertyOrIndex any, delta int64) error {
+	if err := t.ops.Increment(*objId.ToOpId(t.ops), propertyOrIndex, delta); err != nil {
+		return err
+	}
+	t.updatePendingOps()
+	return nil
+}
+
+// Splice deletes del characters at pos of a text object and inserts text there. Positions are
+// counted in the text encoding of the OpSet.
+func (t *TransactionImpl) Splice(objId opset.ExOpId, pos int, del int, text string) error {
+	if del < 0 {
+		return errors.InvalidOperationError{Reason: "cannot delete a negative number of characters"}
+	}
+	operations, err := t.ops.Splice(*objId.ToOpId(t.ops), pos, del, text)
+	for _, op := range operations {
+		t.addOperation(op)
+	}
+	return err
+}
+
+// Mark formats the characters from start to end of a text object with the mark name
+func (t *TransactionImpl) Mark(objId opset.ExOpId, start int, end int, name string, value any, expand opset.ExpandPolicy) error {
+	if value == nil {
+		return errors.InvalidOperationError{Reason: "cannot mark with a nil value, use Unmark"}
+	}
+	value, err := opset.NormalizeScalar(value)
+	if err != nil {
+		return err
+	}
+	if err := t.ops.Mark(*objId.ToOpId(t.ops), start, end, name, value, expand); err != nil {
+		return err
+	}
+	t.updatePendingOps()
+	return nil
+}
+
+// Unmark removes the mark name from the characters from start to end of a text object
+func (t *TransactionImpl) Unmark(objId opset.ExOpId, start int, end int, name string, expand opset.ExpandPolicy) error {
+	if err := t.ops.Mark(*objId.ToOpId(t.ops), start, end, name, nil, expand); err != nil {
+		return err
+	}
+	t.updatePendingOps()
+	return nil
+}
+
 func (t *TransactionImpl) Move(srcObjId opset.ExOpId, dstObjId opset.ExOpId, srcPropertyOrIndex any, dstPropertyOrIndex any) error {
 	if err := t.ops.GenericMove(*srcObjId.ToOpId(t.ops), *dstObjId.ToOpId(t.ops), srcPropertyOrIndex, dstPropertyOrIndex); err == nil {
 		t.updatePendingOps()
@@ -141,6 +198,55 @@ func (t *TransactionImpl) Commit() (*Change, error) {
 	return NewChange(t.actorId, t.seq, copiedOps, t.deps, t.startOpCounter, t.ops), nil
 }
 
+// Rollback undoes all pending operations, leaving the OpSet as it was before the transaction
+func (t *TransactionImpl) Rollback() {
+	t.ops.Rollback(t.pendingOperations, t.prevLamportClock, t.prevLastOperation)
+	t.pendingOperations = nil
+}
+
+// PutPath puts value at the property or list element a path leads to, see opset.ToPath
+func (t *TransactionImpl) PutPath(path any, value any) error {
+	objId, key, err := t.resolvePath(path)
+	if err != nil {
+		return err
+	}
+	return t.Put(objId, key, value)
+}
+
+// PutObjectPath creates an object at the property a path leads to
+func (t *TransactionImpl) PutObjectPath(path any, objType opset.ObjType) (opset.ExOpId, error) {
+	objId, key, err := t.resolvePath(path)
+	if err != nil {
+		return opset.ExOpId{}, err
+	}
+	property, ok := key.(string)
+	if !ok {
+		return opset.ExOpId{}, errors.InvalidOperationError{Reason: "cannot put object on a list"}
+	}
+	return t.PutObject(objId, property, objType)
+}
+
+func (t *TransactionImpl) resolvePath(path any) (opset.ExOpId, any, error) {
+	segments, err := opset.ToPath(path)
+	if err != nil {
+		return opset.ExOpId{}, nil, err
+	}
+	objId, key, err := t.ops.ResolvePath(segments)
+	if err != nil {
+		return opset.ExOpId{}, nil, err
+	}
+	return *objId.ToExOpId(t.ops), key, nil
+}
+
+// Invert undoes the effect of an earlier change of this document, see OpSet.Invert
+func (t *TransactionImpl) Invert(change *Change) error {
+	operations, err := t.ops.Invert(change.Operations, t.ops.GetIdx(t.actorId))
+	for _, op := range operations {
+		t.addOperation(op)
+	}
+	return err
+}
+
 func (t *TransactionImpl) MoveObject(srcObjId opset.ExOpId, dstObjId opset.ExOpId) error {
 	if err := t.ops.MoveObject(*srcObjId.ToOpId(t.ops), *dstObjId.ToOpId(t.ops)); err == nil {
 		t.updatePendingOps()
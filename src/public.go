@@ -20,8 +20,31 @@ type OpId = opset.OpId
 type OpSet = opset.OpSet
 type ActionType = opset.ActionType
 type ObjType = opset.ObjType
+type ConflictValue = opset.ConflictValue
+type Transaction = transaction.Transaction
+type TextEncoding = opset.TextEncoding
+type ExpandPolicy = opset.ExpandPolicy
+type MarkSpan = opset.MarkSpan
+type Counter = opset.Counter
+type Cursor = opset.Cursor
+type Patch = opset.Patch
+type PatchAction = opset.PatchAction
+type MoveLogStats = opset.MoveLogStats
 
 // const
 
 const MAP = opset.MAP
 const LIST = opset.LIST
+const TEXT = opset.TEXT
+const CodePoint = opset.CodePoint
+const UTF16 = opset.UTF16
+const ExpandNone = opset.ExpandNone
+const ExpandBefore = opset.ExpandBefore
+const ExpandAfter = opset.ExpandAfter
+const ExpandBoth = opset.ExpandBoth
+const PatchPut = opset.PatchPut
+const PatchDelete = opset.PatchDelete
+const PatchInsert = opset.PatchInsert
+const PatchSplice = opset.PatchSplice
+const PatchMove = opset.PatchMove
+const PatchConflict = opset.PatchConflict
@@ -0,0 +1,207 @@
+package automergeproto
+
+import (
+	"encoding/json"
+	"github.com/LiangrunDa/AutomergeWithMove/errors"
+	"github.com/LiangrunDa/AutomergeWithMove/internal/opset"
+)
+
+// The read API works on the committed state without starting a transaction, so reading doesn't
+// allocate a sequence number and concurrent readers don't block each other.
+
+func (a *Automerge) lookup(objId ExOpId) (OpId, error) {
+	if id, ok := objId.Lookup(a.ops); ok {
+		return id, nil
+	}
+	return OpId{}, errors.ObjectNotFoundError{ObjId: objId.String()}
+}
+
+// Get returns the value of a property of a map or an element of a list. Objects are returned as ExOpId.
+func (a *Automerge) Get(objId ExOpId, propertyOrIndex any) (any, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, err := a.lookup(objId)
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.ops.Get(id, propertyOrIndex)
+	return a.ops.ToExValue(res), err
+}
+
+// GetAll returns every value concurrently visible at a property or list element, so that conflicts
+// can be shown to the user. The last one is the value returned by Get.
+func (a *Automerge) GetAll(objId ExOpId, propertyOrIndex any) ([]ConflictValue, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, err := a.lookup(objId)
+	if err != nil {
+		return nil, err
+	}
+	return a.ops.GetAll(id, propertyOrIndex)
+}
+
+// Keys returns the visible properties of a map in sorted order
+func (a *Automerge) Keys(objId ExOpId) ([]string, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, err := a.lookup(objId)
+	if err != nil {
+		return nil, err
+	}
+	return a.ops.Keys(id)
+}
+
+// KeysInRange returns the visible properties of a map from from up to but excluding to, in sorted
+// order. An empty to means up to the last property.
+func (a *Automerge) KeysInRange(objId ExOpId, from string, to string) ([]string, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, err := a.lookup(objId)
+	if err != nil {
+		return nil, err
+	}
+	return a.ops.KeysInRange(id, from, to)
+}
+
+// KeysWithPrefix returns the visible properties of a map that start with prefix, in sorted order
+func (a *Automerge) KeysWithPrefix(objId ExOpId, prefix string) ([]string, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, err := a.lookup(objId)
+	if err != nil {
+		return nil, err
+	}
+	return a.ops.KeysWithPrefix(id, prefix)
+}
+
+// Length returns the number of visible properties of a map or elements of a list. The length of a
+// text is counted in the text encoding of the document.
+func (a *Automerge) Length(objId ExOpId) (int, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, err := a.lookup(objId)
+	if err != nil {
+		return 0, err
+	}
+	return a.ops.Length(id)
+}
+
+// Values returns the values of a map in key order, or the elements of a list
+func (a *Automerge) Values(objId ExOpId) ([]any, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, err := a.lookup(objId)
+	if err != nil {
+		return nil, err
+	}
+	return a.ops.Values(id)
+}
+
+func (a *Automerge) ObjectType(objId ExOpId) (ObjType, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, err := a.lookup(objId)
+	if err != nil {
+		return 0, err
+	}
+	return a.ops.ObjectType(id)
+}
+
+// Materialize returns the visible state of an object and everything below it as nested
+// map[string]any and []any values
+func (a *Automerge) Materialize(objId ExOpId) (any, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, err := a.lookup(objId)
+	if err != nil {
+		return nil, err
+	}
+	return a.ops.Materialize(id)
+}
+
+// ToJSON returns the visible state of an object and everything below it as JSON
+func (a *Automerge) ToJSON(objId ExOpId) ([]byte, error) {
+	value, err := a.Materialize(objId)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// Text returns the content of a text object as a string
+func (a *Automerge) Text(objId ExOpId) (string, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, err := a.lookup(objId)
+	if err != nil {
+		return "", err
+	}
+	return a.ops.Text(id)
+}
+
+// Marks returns the resolved formatting of a text object, ordered by start and name
+func (a *Automerge) Marks(objId ExOpId) ([]MarkSpan, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, err := a.lookup(objId)
+	if err != nil {
+		return nil, err
+	}
+	return a.ops.Marks(id)
+}
+
+// GetCursor returns a cursor for the element at index of a list or text, which keeps pointing to the
+// element while the document changes
+func (a *Automerge) GetCursor(objId ExOpId, index int) (Cursor, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, err := a.lookup(objId)
+	if err != nil {
+		return Cursor{}, err
+	}
+	return a.ops.GetCursor(id, index)
+}
+
+// ResolveCursor returns the list or text the element of a cursor is in now and its current index.
+// It returns an ElementDeletedError if the element is deleted.
+func (a *Automerge) ResolveCursor(cursor Cursor) (ExOpId, int, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, index, err := a.ops.ResolveCursor(cursor)
+	if err != nil {
+		return ExOpId{}, 0, err
+	}
+	return *id.ToExOpId(a.ops), index, nil
+}
+
+// GetPath returns the value at a path like "students/0/name" or []any{"students", 0, "name"}.
+// Objects are returned as ExOpId.
+func (a *Automerge) GetPath(path any) (any, error) {
+	segments, err := opset.ToPath(path)
+	if err != nil {
+		return nil, err
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if len(segments) == 0 {
+		return ExRootOpId, nil
+	}
+	objId, key, err := a.ops.ResolvePath(segments)
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.ops.Get(objId, key)
+	return a.ops.ToExValue(res), err
+}
+
+// PathOf returns the properties and current list indexes that lead from the root to an object. It
+// fails if the object is deleted.
+func (a *Automerge) PathOf(objId ExOpId) ([]any, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	id, err := a.lookup(objId)
+	if err != nil {
+		return nil, err
+	}
+	return a.ops.PathOf(id)
+}
@@ -0,0 +1,263 @@
+package automergeproto
+
+import (
+	"github.com/LiangrunDa/AutomergeWithMove/internal/opset"
+	"reflect"
+	"strconv"
+)
+
+// RevertTo creates a local change that restores the visible state the document had at the given
+// heads. Objects that were moved since are moved back; objects that were deleted since are
+// recreated with new ids, because deleted objects can't be brought back. Counters are incremented
+// back to their old values, so that concurrent increments still count.
+func (a *Automerge) RevertTo(heads []ChangeHash) error {
+	_, err := a.Transact(func(tx Transaction) error {
+		// the transaction holds the lock, so no change can land between reading and restoring
+		old, err := a.opSetAt(heads)
+		if err != nil {
+			return err
+		}
+		r := &reverter{
+			ops:     a.ops,
+			old:     old,
+			tx:      tx,
+			targets: map[ExOpId]ExOpId{},
+		}
+		// place every old object first and delete what is left over afterwards, so that objects
+		// which moved away are moved back instead of being deleted and recreated
+		if err := r.place(ExRootOpId, ExRootOpId); err != nil {
+			return err
+		}
+		return r.prune(ExRootOpId)
+	})
+	return err
+}
+
+type reverter struct {
+	ops     *OpSet
+	old     *OpSet
+	tx      Transaction
+	targets map[ExOpId]ExOpId // object in the old state -> object restoring it in the current state
+}
+
+func (r *reverter) oldId(objId ExOpId) OpId {
+	id, _ := objId.Lookup(r.old)
+	return id
+}
+
+func (r *reverter) currentId(objId ExOpId) OpId {
+	return *objId.ToOpId(r.ops)
+}
+
+// location returns where a present object currently is
+func (r *reverter) location(objId ExOpId) (ExOpId, any, error) {
+	id, ok := objId.Lookup(r.ops)
+	if !ok {
+		return ExOpId{}, nil, nil
+	}
+	parent, property, err := r.ops.Location(id)
+	if err != nil {
+		return ExOpId{}, nil, err
+	}
+	return *parent.ToExOpId(r.ops), property, nil
+}
+
+// place makes the content of target equal to the old content of objId
+func (r *reverter) place(objId ExOpId, target ExOpId) error {
+	r.targets[objId] = target
+	objType, _ := r.old.ObjectType(r.oldId(objId))
+	if objType == opset.MAP {
+		return r.placeMap(objId, target)
+	}
+	return r.placeList(objId, target)
+}
+
+func (r *reverter) placeMap(objId ExOpId, target ExOpId) error {
+	keys, _ := r.old.Keys(r.oldId(objId))
+	for _, key := range keys {
+		oldValue, _ := r.old.Get(r.oldId(objId), key)
+		oldValue = r.old.ToExValue(oldValue)
+		current, err := r.tx.Get(target, key)
+		if child, ok := oldValue.(ExOpId); ok {
+			if err == nil && current == child {
+				if err := r.place(child, child); err != nil {
+					return err
+				}
+				continue
+			}
+			if err == nil {
+				if err := r.displace(target, key, current); err != nil {
+					return err
+				}
+			}
+			err := r.restoreChild(child, target, key, func(objType opset.ObjType) (ExOpId, error) {
+				return r.tx.PutObject(target, key, objType)
+			})
+			if err != nil {
+				return err
+			}
+		} else if err != nil || !reflect.DeepEqual(current, oldValue) {
+			if err := r.restoreScalar(target, key, current, oldValue); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *reverter) placeList(objId ExOpId, target ExOpId) error {
+	oldValues, _ := r.old.Values(r.oldId(objId))
+	for i, oldValue := range oldValues {
+		currentValues, _ := r.ops.Values(r.currentId(target))
+		var current any
+		if i < len(currentValues) {
+			current = currentValues[i]
+		}
+		if child, ok := oldValue.(ExOpId); ok {
+			if current == child {
+				if err := r.place(child, child); err != nil {
+					return err
+				}
+				continue
+			}
+			// moving or inserting the child shifts the current element, so nothing is overwritten
+			err := r.restoreChild(child, target, i, func(objType opset.ObjType) (ExOpId, error) {
+				return r.tx.InsertObject(target, i, objType)
+			})
+			if err != nil {
+				return err
+			}
+		} else if i < len(currentValues) && reflect.DeepEqual(current, oldValue) {
+			continue
+		} else if _, isObject := current.(ExOpId); i < len(currentValues) && !isObject {
+			if err := r.restoreScalar(target, i, current, oldValue); err != nil {
+				return err
+			}
+		} else {
+			// keep the current object, it might have to be moved somewhere else
+			if err := r.tx.Insert(target, i, oldValue); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restoreChild moves an old child object to propertyOrIndex of target, or creates it there again if
+// it was deleted
+func (r *reverter) restoreChild(child ExOpId, target ExOpId, propertyOrIndex any, create func(opset.ObjType) (ExOpId, error)) error {
+	if parent, property, err := r.location(child); err == nil && property != nil {
+		if err := r.tx.Move(parent, target, property, propertyOrIndex); err != nil {
+			return err
+		}
+		return r.place(child, child)
+	}
+	childType, _ := r.old.ObjectType(r.oldId(child))
+	newChild, err := create(childType)
+	if err != nil {
+		return err
+	}
+	return r.place(child, newChild)
+}
+
+// displace moves the current value of a map key out of the way if it is an object that still has
+// to be placed somewhere else, e.g. when two objects were swapped, so that it isn't overwritten
+func (r *reverter) displace(target ExOpId, key string, current any) error {
+	object, ok := current.(ExOpId)
+	if !ok {
+		return nil
+	}
+	if _, placed := r.targets[object]; placed {
+		return nil
+	}
+	if id, ok := object.Lookup(r.old); !ok {
+		return nil
+	} else if _, _, err := r.old.Location(id); err != nil {
+		return nil // not part of the old state
+	}
+	// a key that is in neither state, the object moves away from it when it is placed
+	for i := 0; ; i++ {
+		temporary := "revert-" + strconv.Itoa(i)
+		if _, err := r.tx.Get(target, temporary); err == nil {
+			continue
+		}
+		if _, err := r.old.Get(r.oldId(target), temporary); err == nil {
+			continue
+		}
+		return r.tx.Move(target, target, key, temporary)
+	}
+}
+
+// restoreScalar puts an old scalar value back. A counter is incremented by the difference instead,
+// so that increments concurrent with the revert aren't lost.
+func (r *reverter) restoreScalar(target ExOpId, propertyOrIndex any, current any, oldValue any) error {
+	if oldCounter, ok := oldValue.(Counter); ok {
+		if counter, ok := current.(Counter); ok {
+			return r.tx.Increment(target, propertyOrIndex, int64(oldCounter-counter))
+		}
+	}
+	return r.tx.Put(target, propertyOrIndex, oldValue)
+}
+
+// prune deletes what is left over in the restored objects after placing the old content
+func (r *reverter) prune(objId ExOpId) error {
+	target := r.targets[objId]
+	objType, _ := r.old.ObjectType(r.oldId(objId))
+	oldValues, _ := r.old.Values(r.oldId(objId))
+	if objType == opset.MAP {
+		oldKeys, _ := r.old.Keys(r.oldId(objId))
+		keep := map[string]bool{}
+		for _, key := range oldKeys {
+			keep[key] = true
+		}
+		keys, _ := r.ops.Keys(r.currentId(target))
+		for _, key := range keys {
+			if !keep[key] {
+				if err := r.tx.Delete(target, key); err != nil {
+					return err
+				}
+			}
+		}
+	} else {
+		length, _ := r.ops.Length(r.currentId(target))
+		for i := length - 1; i >= len(oldValues); i-- {
+			if err := r.tx.Delete(target, i); err != nil {
+				return err
+			}
+		}
+		if objType == opset.TEXT {
+			if err := r.restoreMarks(objId, target); err != nil {
+				return err
+			}
+		}
+	}
+	for _, value := range oldValues {
+		if child, ok := value.(ExOpId); ok {
+			if err := r.prune(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restoreMarks formats the restored text like the old one. The spans of the old marks don't tell
+// how they expanded, so the restored marks don't expand.
+func (r *reverter) restoreMarks(objId ExOpId, target ExOpId) error {
+	oldMarks, _ := r.old.Marks(r.oldId(objId))
+	marks, _ := r.ops.Marks(r.currentId(target))
+	if reflect.DeepEqual(oldMarks, marks) {
+		return nil
+	}
+	for _, mark := range marks {
+		if err := r.tx.Unmark(target, mark.Start, mark.End, mark.Name, ExpandNone); err != nil {
+			return err
+		}
+	}
+	for _, mark := range oldMarks {
+		if err := r.tx.Mark(target, mark.Start, mark.End, mark.Name, mark.Value, ExpandNone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package automergeproto
+
+import (
+	"bytes"
+	"github.com/LiangrunDa/AutomergeWithMove/internal/syncmsg"
+	"github.com/LiangrunDa/AutomergeWithMove/internal/transaction"
+	"sort"
+)
+
+// SyncState is the state a peer keeps about one other peer while syncing with it.
+// Only the shared heads are persisted by Encode; everything else is per connection.
+type SyncState struct {
+	sharedHeads   []ChangeHash // heads both peers are known to have
+	lastSentHeads []ChangeHash // our heads at the time of the last message we sent
+	theirHeads    []ChangeHash // nil until we receive their first message
+	theirNeed     []ChangeHash
+	theirHave     []syncmsg.Have
+	sentHashes    map[ChangeHash]bool // changes we sent during this connection
+}
+
+func NewSyncState() *SyncState {
+	return &SyncState{
+		sharedHeads:   make([]ChangeHash, 0),
+		lastSentHeads: make([]ChangeHash, 0),
+		sentHashes:    map[ChangeHash]bool{},
+	}
+}
+
+// Encode serializes the state, so that a reconnecting peer doesn't resend everything
+func (state *SyncState) Encode() []byte {
+	return syncmsg.EncodeState(state.sharedHeads)
+}
+
+func DecodeSyncState(bytes []byte) (*SyncState, error) {
+	sharedHeads, err := syncmsg.DecodeState(bytes)
+	if err != nil {
+		return nil, err
+	}
+	state := NewSyncState()
+	state.sharedHeads = sharedHeads
+	return state, nil
+}
+
+// GenerateSyncMessage returns the next message to send to the peer, or false if there is nothing to
+// send because both peers are in sync
+func (a *Automerge) GenerateSyncMessage(state *SyncState) ([]byte, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ourHeads := append([]ChangeHash{}, a.dependencies...)
+	sortHashes(ourHeads)
+	ourNeed := a.getMissingDeps(state.theirHeads)
+
+	// only advertise what we have if we are not waiting for changes they already told us about
+	ourHave := make([]syncmsg.Have, 0)
+	if state.theirHeads == nil || containsAll(state.theirHeads, ourNeed) {
+		ourHave = append(ourHave, a.makeHave(state.sharedHeads))
+	}
+
+	if len(state.theirHave) > 0 {
+		for _, hash := range state.theirHave[0].LastSync {
+			if _, ok := a.historyIndex[hash]; !ok {
+				// they remember a shared state we don't know (e.g. we lost data), so start over
+				reset := &syncmsg.Message{
+					Heads: ourHeads,
+					Need:  make([]ChangeHash, 0),
+					Have:  []syncmsg.Have{{LastSync: make([]ChangeHash, 0), Bloom: []byte{}}},
+				}
+				return reset.Encode(), true
+			}
+		}
+	}
+
+	changesToSend := make([]*Change, 0)
+	if state.theirHave != nil && state.theirNeed != nil {
+		changesToSend = a.getChangesToSend(state.theirHave, state.theirNeed)
+	}
+	headsUnchanged := equalHashes(ourHeads, state.lastSentHeads)
+	headsEqual := state.theirHeads != nil && equalHashes(ourHeads, state.theirHeads)
+	if headsUnchanged && headsEqual && len(changesToSend) == 0 {
+		return nil, false
+	}
+
+	filtered := make([]*Change, 0)
+	for _, change := range changesToSend {
+		if !state.sentHashes[change.Hash()] {
+			filtered = append(filtered, change)
+			state.sentHashes[change.Hash()] = true
+		}
+	}
+	msg := &syncmsg.Message{
+		Heads: ourHeads,
+		Need:  ourNeed,
+		Have:  ourHave,
+	}
+	if len(filtered) > 0 {
+		msg.Changes = transaction.EncodeChanges(filtered, a.ops)
+	}
+	state.lastSentHeads = ourHeads
+	return msg.Encode(), true
+}
+
+// ReceiveSyncMessage applies the changes contained in a message of the peer and updates the state
+func (a *Automerge) ReceiveSyncMessage(state *SyncState, msg []byte) error {
+	message, err := syncmsg.DecodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	beforeHeads := append([]ChangeHash{}, a.dependencies...)
+	var patches [][]Patch
+	if len(message.Changes) > 0 {
+		// decoding registers the actors of the changes in the OpSet, so it needs the lock, too
+		changes, err := transaction.DecodeChanges(message.Changes, a.ops)
+		if err != nil {
+			a.lock.Unlock()
+			return err
+		}
+		_, patches = a.applyChanges(changes)
+		state.sharedHeads = advanceHeads(beforeHeads, a.dependencies, state.sharedHeads)
+	} else if state.theirHeads != nil && equalHashes(message.Heads, sortedCopy(beforeHeads)) {
+		// they are at our heads, so there's no need to tell them our heads again. Their first
+		// message is answered anyway, since they don't know our heads yet.
+		state.lastSentHeads = message.Heads
+	}
+
+	knownHeads := make([]ChangeHash, 0)
+	for _, head := range message.Heads {
+		if _, ok := a.historyIndex[head]; ok {
+			knownHeads = append(knownHeads, head)
+		}
+	}
+	a.unlockAndNotify(patches)
+
+	if len(knownHeads) == len(message.Heads) {
+		state.sharedHeads = message.Heads
+		if len(message.Heads) == 0 {
+			// they have nothing, so everything we sent before has been lost
+			state.lastSentHeads = make([]ChangeHash, 0)
+			state.sentHashes = map[ChangeHash]bool{}
+		}
+	} else {
+		state.sharedHeads = uniqueSorted(append(knownHeads, state.sharedHeads...))
+	}
+	state.theirHave = message.Have
+	state.theirHeads = message.Heads
+	state.theirNeed = message.Need
+	return nil
+}
+
+// makeHave summarizes the changes added since lastSync in a Bloom filter
+func (a *Automerge) makeHave(lastSync []ChangeHash) syncmsg.Have {
+	hashes := make([]ChangeHash, 0)
+	for _, change := range a.getChanges(lastSync) {
+		hashes = append(hashes, change.Hash())
+	}
+	return syncmsg.Have{
+		LastSync: lastSync,
+		Bloom:    syncmsg.NewBloomFilter(hashes).Bytes(),
+	}
+}
+
+// getChangesToSend returns the changes the peer doesn't have according to their Bloom filters,
+// together with everything depending on them and the changes they explicitly asked for
+func (a *Automerge) getChangesToSend(have []syncmsg.Have, need []ChangeHash) []*Change {
+	if len(have) == 0 {
+		changes := make([]*Change, 0)
+		for _, hash := range need {
+			if idx, ok := a.historyIndex[hash]; ok {
+				changes = append(changes, a.history[idx])
+			}
+		}
+		return changes
+	}
+
+	lastSync := make([]ChangeHash, 0)
+	filters := make([]*syncmsg.BloomFilter, 0)
+	for _, h := range have {
+		lastSync = append(lastSync, h.LastSync...)
+		if filter, err := syncmsg.DecodeBloomFilter(h.Bloom); err == nil {
+			filters = append(filters, filter)
+		}
+	}
+	changes := a.getChanges(lastSync)
+
+	isCandidate := map[ChangeHash]bool{}
+	dependents := map[ChangeHash][]ChangeHash{}
+	toSend := map[ChangeHash]bool{}
+	for _, change := range changes {
+		isCandidate[change.Hash()] = true
+		for _, dep := range change.Dependencies {
+			dependents[dep] = append(dependents[dep], change.Hash())
+		}
+		inFilter := false
+		for _, filter := range filters {
+			if filter.ContainsHash(change.Hash()) {
+				inFilter = true
+				break
+			}
+		}
+		if !inFilter {
+			toSend[change.Hash()] = true
+		}
+	}
+
+	// a change that depends on a change they don't have can't be in their history either
+	stack := make([]ChangeHash, 0, len(toSend))
+	for hash := range toSend {
+		stack = append(stack, hash)
+	}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, dependent := range dependents[hash] {
+			if !toSend[dependent] {
+				toSend[dependent] = true
+				stack = append(stack, dependent)
+			}
+		}
+	}
+
+	result := make([]*Change, 0)
+	for _, hash := range need {
+		toSend[hash] = true
+		if !isCandidate[hash] {
+			if idx, ok := a.historyIndex[hash]; ok {
+				result = append(result, a.history[idx])
+			}
+		}
+	}
+	for _, change := range changes {
+		if toSend[change.Hash()] {
+			result = append(result, change)
+		}
+	}
+	return result
+}
+
+// advanceHeads returns the shared heads after we added changes: our new heads that came from the
+// peer, plus the old shared heads that are still heads
+func advanceHeads(oldHeads []ChangeHash, newHeads []ChangeHash, oldSharedHeads []ChangeHash) []ChangeHash {
+	advanced := make([]ChangeHash, 0)
+	for _, head := range newHeads {
+		if !containsHash(oldHeads, head) {
+			advanced = append(advanced, head)
+		}
+	}
+	for _, head := range oldSharedHeads {
+		if containsHash(newHeads, head) {
+			advanced = append(advanced, head)
+		}
+	}
+	return uniqueSorted(advanced)
+}
+
+func sortHashes(hashes []ChangeHash) {
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+}
+
+func sortedCopy(hashes []ChangeHash) []ChangeHash {
+	copied := append([]ChangeHash{}, hashes...)
+	sortHashes(copied)
+	return copied
+}
+
+func uniqueSorted(hashes []ChangeHash) []ChangeHash {
+	sorted := sortedCopy(hashes)
+	result := make([]ChangeHash, 0, len(sorted))
+	for i, hash := range sorted {
+		if i == 0 || hash != sorted[i-1] {
+			result = append(result, hash)
+		}
+	}
+	return result
+}
+
+func containsHash(hashes []ChangeHash, hash ChangeHash) bool {
+	for _, h := range hashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAll(hashes []ChangeHash, subset []ChangeHash) bool {
+	for _, hash := range subset {
+		if !containsHash(hashes, hash) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalHashes(a []ChangeHash, b []ChangeHash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
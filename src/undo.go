@@ -0,0 +1,106 @@
+package automergeproto
+
+import (
+	"errors"
+)
+
+// UndoManager records the local transactions of a document and undoes or redoes them with new
+// changes, so that undoing is synchronized to other peers like any other edit. Edits of other actors
+// that happened in the meantime are kept, see Transaction.Invert.
+type UndoManager struct {
+	doc   *Automerge
+	undos [][]*Change // every step holds the changes to invert, in the order they were made
+	redos [][]*Change
+	group []*Change
+	depth int // nesting level of StartGroup
+}
+
+func NewUndoManager(doc *Automerge) *UndoManager {
+	return &UndoManager{doc: doc}
+}
+
+// Transact runs fn in a transaction of the document like Automerge.Transact and records the change
+// as an undo step. It discards the steps that could be redone.
+func (u *UndoManager) Transact(fn func(tx Transaction) error) (*Change, error) {
+	change, err := u.doc.Transact(fn)
+	if err != nil {
+		return nil, err
+	}
+	u.redos = nil
+	if u.depth > 0 {
+		u.group = append(u.group, change)
+	} else {
+		u.undos = append(u.undos, []*Change{change})
+	}
+	return change, nil
+}
+
+// StartGroup makes the following transactions one undo step, until the matching EndGroup
+func (u *UndoManager) StartGroup() {
+	u.depth++
+}
+
+func (u *UndoManager) EndGroup() {
+	if u.depth == 0 {
+		return
+	}
+	u.depth--
+	if u.depth == 0 && len(u.group) > 0 {
+		u.undos = append(u.undos, u.group)
+		u.group = nil
+	}
+}
+
+func (u *UndoManager) CanUndo() bool {
+	return len(u.undos) > 0
+}
+
+func (u *UndoManager) CanRedo() bool {
+	return len(u.redos) > 0
+}
+
+// Undo inverts the last undo step in a new transaction, which becomes a redo step. A group that is
+// still open is closed first, so that its transactions are undone as one step.
+func (u *UndoManager) Undo() error {
+	if u.depth > 0 {
+		u.depth = 1
+		u.EndGroup()
+	}
+	if !u.CanUndo() {
+		return errors.New("nothing to undo")
+	}
+	step := u.undos[len(u.undos)-1]
+	change, err := u.invert(step)
+	if err != nil {
+		return err
+	}
+	u.undos = u.undos[:len(u.undos)-1]
+	u.redos = append(u.redos, []*Change{change})
+	return nil
+}
+
+// Redo inverts the last undone step again in a new transaction
+func (u *UndoManager) Redo() error {
+	if !u.CanRedo() {
+		return errors.New("nothing to redo")
+	}
+	step := u.redos[len(u.redos)-1]
+	change, err := u.invert(step)
+	if err != nil {
+		return err
+	}
+	u.redos = u.redos[:len(u.redos)-1]
+	u.undos = append(u.undos, []*Change{change})
+	return nil
+}
+
+func (u *UndoManager) invert(step []*Change) (*Change, error) {
+	return u.doc.Transact(func(tx Transaction) error {
+		for i := len(step) - 1; i >= 0; i-- {
+			if err := tx.Invert(step[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}